@@ -0,0 +1,238 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/gateway"
+	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/metrics"
+	"github.com/yarlson/GateH8/upstream"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// redacted replaces the secrets of the configuration exposed by the admin listener.
+const redacted = "REDACTED"
+
+// NewRouter builds the handler of the admin listener, which exposes the internal
+// state of the running gateway for introspection, and its metrics in the Prometheus format.
+// It also lets the gateway be controlled at runtime: reload is called to reload the
+// configuration. When the admin configuration has a token, requests must present it.
+func NewRouter(gw *gateway.Gateway, cfg *config.AdminConfig, reload func() error) *chi.Mux {
+	r := chi.NewRouter()
+	if cfg.Token != "" {
+		r.Use(requireToken(cfg.Token))
+	}
+
+	r.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, redactConfig(gw.Config()))
+	})
+
+	r.Get("/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, gw.Routes())
+	})
+
+	r.Get("/backends", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, gw.Registry().Status())
+	})
+
+	r.Post("/backends/drain", drainHandler(gw, true))
+	r.Post("/backends/resume", drainHandler(gw, false))
+
+	r.Handle("/metrics", metrics.Handler(newGatewayCollector(gw)))
+
+	r.Get("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions := gw.Sessions().List()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":    len(sessions),
+			"sessions": sessions,
+		})
+	})
+
+	r.Post("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reload(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	})
+
+	r.Get("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string][]string{"vhosts": gw.Maintenance().Vhosts()})
+	})
+
+	r.Post("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Vhost   string `json:"vhost"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := gw.Config().Vhosts[req.Vhost]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("vhost %q not found", req.Vhost))
+			return
+		}
+		gw.Maintenance().Set(req.Vhost, req.Enabled)
+		logger.FromContext(r.Context()).WithField(logger.FieldVhost, req.Vhost).Warnf("Maintenance mode set to %v", req.Enabled)
+		writeJSON(w, http.StatusOK, map[string][]string{"vhosts": gw.Maintenance().Vhosts()})
+	})
+
+	return r
+}
+
+// Listen opens the listener of the admin configuration: the Unix socket, if set, or the
+// TCP address. A stale socket left by a previous process is replaced, but any other file
+// at the socket path is left alone. The socket is only accessible to the user running the
+// gateway.
+func Listen(cfg *config.AdminConfig) (net.Listener, error) {
+	if cfg.Socket == "" {
+		return net.Listen("tcp", cfg.Addr)
+	}
+
+	info, err := os.Lstat(cfg.Socket)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", cfg.Socket)
+	default:
+		if err := os.Remove(cfg.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	// The socket is created with restrictive permissions, rather than restricted once
+	// already reachable by other users.
+	var listener net.Listener
+	withUmask(0o177, func() {
+		listener, err = net.Listen("unix", cfg.Socket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(cfg.Socket, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// requireToken is a middleware rejecting the requests that do not present the token as a
+// bearer token in their Authorization header.
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gateh8-admin"`)
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or missing admin token"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// drainHandler starts or stops draining the target of a backend pool given in the request body.
+func drainHandler(gw *gateway.Gateway, draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Backend string `json:"backend"`
+			Target  string `json:"target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		registry := gw.Registry()
+		if err := registry.Drain(req.Backend, req.Target, draining); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, upstream.ErrPoolNotFound) || errors.Is(err, upstream.ErrTargetNotFound) {
+				status = http.StatusNotFound
+			}
+			writeError(w, status, err)
+			return
+		}
+		logger.FromContext(r.Context()).WithFields(logrus.Fields{
+			"pool":   req.Backend,
+			"target": req.Target,
+		}).Warnf("Upstream target draining set to %v", draining)
+
+		pool, _ := registry.Pool(req.Backend)
+		writeJSON(w, http.StatusOK, pool.Status())
+	}
+}
+
+// redactConfig returns a copy of the configuration without its secrets.
+func redactConfig(cfg *config.Config) *config.Config {
+	redactedCfg := *cfg
+	if cfg.Admin != nil && cfg.Admin.Token != "" {
+		admin := *cfg.Admin
+		admin.Token = redacted
+		redactedCfg.Admin = &admin
+	}
+	if cfg.Tracing != nil && len(cfg.Tracing.Headers) > 0 {
+		tracing := *cfg.Tracing
+		tracing.Headers = make(map[string]string, len(cfg.Tracing.Headers))
+		for key := range cfg.Tracing.Headers {
+			tracing.Headers[key] = redacted
+		}
+		redactedCfg.Tracing = &tracing
+	}
+	// The key hashes are not salted, and could be brute-forced offline.
+	if len(cfg.Consumers) > 0 {
+		redactedCfg.Consumers = slices.Clone(cfg.Consumers)
+		for i := range redactedCfg.Consumers {
+			keys := make([]string, len(cfg.Consumers[i].Keys))
+			for j := range keys {
+				keys[j] = redacted
+			}
+			redactedCfg.Consumers[i].Keys = keys
+		}
+	}
+	redactedCfg.Vhosts = make(map[string]config.Vhost, len(cfg.Vhosts))
+	for name, vhost := range cfg.Vhosts {
+		vhost.JWT = redactJWT(vhost.JWT)
+		vhost.Endpoints = slices.Clone(vhost.Endpoints)
+		for i := range vhost.Endpoints {
+			vhost.Endpoints[i].JWT = redactJWT(vhost.Endpoints[i].JWT)
+		}
+		redactedCfg.Vhosts[name] = vhost
+	}
+	return &redactedCfg
+}
+
+// redactJWT returns a copy of the JWT validation settings without their secret.
+func redactJWT(jwt *config.JWT) *config.JWT {
+	if jwt == nil || jwt.Secret == "" {
+		return jwt
+	}
+	redactedJWT := *jwt
+	redactedJWT.Secret = redacted
+	return &redactedJWT
+}
+
+// writeJSON encodes the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.L.WithError(err).Error("Error encoding admin response")
+	}
+}
+
+// writeError writes the error as the JSON body of the response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"errors"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/gateway"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestGateway(t *testing.T) *gateway.Gateway {
+	gw, err := gateway.New(&config.Config{
+		Admin:     &config.AdminConfig{Addr: "127.0.0.1:0", Token: "secret"},
+		Consumers: []config.Consumer{{Name: "mobile", Keys: []string{strings.Repeat("ab", 32)}}},
+		Vhosts: map[string]config.Vhost{
+			"api.example.com": {
+				JWT: &config.JWT{Secret: "jwt-secret"},
+				Endpoints: []config.Endpoint{{
+					Path:    "/users",
+					Methods: []string{http.MethodGet},
+					Backend: &config.Backend{Targets: []config.Target{{URL: "http://a"}, {URL: "http://b"}}},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("gateway.New() error = %v", err)
+	}
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func TestAdminRouter(t *testing.T) {
+	gw := newTestGateway(t)
+	handler := NewRouter(gw, gw.Config().Admin, func() error { return errors.New("invalid configuration") })
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "missing token", method: http.MethodGet, path: "/backends", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodGet, path: "/backends", token: "nope", wantStatus: http.StatusUnauthorized},
+		{name: "redacted config", method: http.MethodGet, path: "/config", token: "secret", wantStatus: http.StatusOK, wantBody: `"token":"REDACTED"`},
+		{name: "redacted JWT secret", method: http.MethodGet, path: "/config", token: "secret", wantStatus: http.StatusOK, wantBody: `"jwt":{"secret":"REDACTED"}`},
+		{name: "redacted consumer keys", method: http.MethodGet, path: "/config", token: "secret", wantStatus: http.StatusOK, wantBody: `"keys":["REDACTED"]`},
+		{name: "routes", method: http.MethodGet, path: "/routes", token: "secret", wantStatus: http.StatusOK, wantBody: `"backend":"api.example.com/users"`},
+		{name: "drain", method: http.MethodPost, path: "/backends/drain", token: "secret", body: `{"backend":"api.example.com/users","target":"http://a"}`, wantStatus: http.StatusOK, wantBody: `"draining":true`},
+		{name: "drain unknown target", method: http.MethodPost, path: "/backends/drain", token: "secret", body: `{"backend":"api.example.com/users","target":"http://c"}`, wantStatus: http.StatusNotFound},
+		{name: "maintenance", method: http.MethodPost, path: "/maintenance", token: "secret", body: `{"vhost":"api.example.com","enabled":true}`, wantStatus: http.StatusOK, wantBody: `["api.example.com"]`},
+		{name: "maintenance unknown vhost", method: http.MethodPost, path: "/maintenance", token: "secret", body: `{"vhost":"nope","enabled":true}`, wantStatus: http.StatusNotFound},
+		{name: "failed reload", method: http.MethodPost, path: "/reload", token: "secret", wantStatus: http.StatusUnprocessableEntity, wantBody: "invalid configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	gw := newTestGateway(t)
+	gw.Maintenance().Set("api.example.com", true)
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/users", nil)
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// The mode survives reloads.
+	if err := gw.Reload(gw.Config()); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status after reload = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	gw.Maintenance().Set("api.example.com", false)
+	if got := gw.Maintenance().Vhosts(); len(got) != 0 {
+		t.Errorf("Vhosts() = %v, want none", got)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A stale socket left by a previous process is replaced.
+	socket := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	if l, ok := stale.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+	_ = stale.Close()
+
+	listener, err := Listen(&config.AdminConfig{Socket: socket})
+	if err != nil {
+		t.Fatalf("Listen() error = %v, want the stale socket replaced", err)
+	}
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+	_ = listener.Close()
+
+	// Any other file is left alone.
+	file := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(file, []byte("{}"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := Listen(&config.AdminConfig{Socket: file}); err == nil {
+		t.Error("Listen() error = nil, want error for a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yarlson/GateH8/gateway"
+)
+
+// gatewayCollector exposes the state of the running gateway as metrics, read from the
+// current configuration every time the metrics are scraped.
+type gatewayCollector struct {
+	gw                *gateway.Gateway
+	activeConnections *prometheus.Desc
+	sessions          *prometheus.Desc
+}
+
+func newGatewayCollector(gw *gateway.Gateway) *gatewayCollector {
+	return &gatewayCollector{
+		gw: gw,
+		activeConnections: prometheus.NewDesc(
+			"gateh8_upstream_active_connections",
+			"Number of requests and WebSocket sessions in flight to the upstream targets.",
+			[]string{"backend", "target"}, nil,
+		),
+		sessions: prometheus.NewDesc(
+			"gateh8_websocket_sessions",
+			"Number of live WebSocket sessions.",
+			[]string{"endpoint"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *gatewayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.activeConnections
+	ch <- c.sessions
+}
+
+// Collect implements prometheus.Collector.
+func (c *gatewayCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pool := range c.gw.Registry().Pools() {
+		for _, target := range pool.Targets() {
+			ch <- prometheus.MustNewConstMetric(c.activeConnections, prometheus.GaugeValue,
+				float64(target.ActiveConnections()), pool.Name(), target.URL)
+		}
+	}
+
+	sessions := make(map[string]int)
+	for _, session := range c.gw.Sessions().List() {
+		sessions[session.Endpoint]++
+	}
+	for endpoint, count := range sessions {
+		ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(count), endpoint)
+	}
+}
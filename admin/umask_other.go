@@ -0,0 +1,9 @@
+//go:build !unix
+
+package admin
+
+// withUmask runs f. Platforms without a file mode creation mask rely on the permissions
+// being restricted once the files are created.
+func withUmask(_ int, f func()) {
+	f()
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package admin
+
+import "syscall"
+
+// withUmask runs f with the file mode creation mask of the process set to mask, so that
+// the files it creates never have looser permissions. The mask applies to the whole
+// process while f runs.
+func withUmask(mask int, f func()) {
+	previous := syscall.Umask(mask)
+	defer syscall.Umask(previous)
+	f()
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/metrics"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// defaultAPIKeyHeader is the header the API key is read from by default.
+const defaultAPIKeyHeader = "X-API-Key"
+
+type contextKey struct {
+	name string
+}
+
+// consumerKey is the context key of the consumer that sent a request.
+var consumerKey = &contextKey{"consumer"}
+
+// ConsumerFromContext returns the API consumer that sent the request, if it was
+// authenticated by its API key.
+func ConsumerFromContext(ctx context.Context) (*config.Consumer, bool) {
+	consumer, ok := ctx.Value(consumerKey).(*config.Consumer)
+	return consumer, ok
+}
+
+// Consumers is the registry of the API consumers, indexed by the hashes of their keys.
+type Consumers struct {
+	byKey map[string]*config.Consumer
+}
+
+// NewConsumers builds the registry of the consumers.
+func NewConsumers(consumers []config.Consumer) *Consumers {
+	c := &Consumers{byKey: make(map[string]*config.Consumer)}
+	for i := range consumers {
+		for _, key := range consumers[i].Keys {
+			c.byKey[strings.ToLower(key)] = &consumers[i]
+		}
+	}
+	return c
+}
+
+// Lookup returns the consumer owning the API key.
+func (c *Consumers) Lookup(key string) (*config.Consumer, bool) {
+	hash := sha256.Sum256([]byte(key))
+	consumer, ok := c.byKey[hex.EncodeToString(hash[:])]
+	return consumer, ok
+}
+
+// APIKey returns a middleware authenticating the consumers by their API key, for the
+// endpoint named after its vhost and path. Requests without a known key are rejected with
+// a 401 Unauthorized, and the ones of consumers not allowed on the endpoint with a 403
+// Forbidden. The key is removed from the request, so that it is neither proxied nor logged.
+// The consumer is recorded in the logs and metrics of the request, and can be forwarded to
+// the backend along with its metadata.
+func APIKey(cfg *config.APIKeyAuth, consumers *Consumers, vhost, path string) func(http.Handler) http.Handler {
+	header := cfg.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(header)
+			r.Header.Del(header)
+			if cfg.QueryParam != "" {
+				if key == "" {
+					key = r.URL.Query().Get(cfg.QueryParam)
+				}
+				// The URL is shared with the access log, which must not see the key either.
+				r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, cfg.QueryParam)
+			}
+
+			log := logger.FromContext(r.Context())
+			consumer, ok := consumers.Lookup(key)
+			if key == "" || !ok {
+				log.Info("API key rejected")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			log = log.WithField(logger.FieldConsumer, consumer.Name)
+			logger.RecordConsumer(r.Context(), consumer.Name)
+			metrics.RecordConsumer(r.Context(), consumer.Name)
+			if !allowed(consumer, vhost, path) {
+				log.Info("API consumer not allowed on the endpoint")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			if cfg.ForwardHeader != "" {
+				r.Header.Set(cfg.ForwardHeader, consumer.Name)
+			}
+			if cfg.ForwardMetadataPrefix != "" {
+				forwardMetadata(r.Header, cfg.ForwardMetadataPrefix, consumer.Metadata)
+			}
+			ctx := context.WithValue(logger.NewContext(r.Context(), log), consumerKey, consumer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// forwardMetadata sets the headers named after the metadata keys with the prefix, and
+// removes the other headers with the prefix, which the client cannot forge.
+func forwardMetadata(header http.Header, prefix string, metadata map[string]string) {
+	prefix = http.CanonicalHeaderKey(prefix)
+	for name := range header {
+		if strings.HasPrefix(name, prefix) {
+			header.Del(name)
+		}
+	}
+	for key, value := range metadata {
+		header.Set(prefix+key, value)
+	}
+}
+
+// allowed reports whether the consumer may use the endpoint of the vhost.
+func allowed(consumer *config.Consumer, vhost, path string) bool {
+	if len(consumer.Vhosts) == 0 && len(consumer.Endpoints) == 0 {
+		return true
+	}
+	for _, pattern := range consumer.Vhosts {
+		if match, _ := filepath.Match(pattern, vhost); match {
+			return true
+		}
+	}
+	for _, pattern := range consumer.Endpoints {
+		if pattern == vhost+path {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, vhost+path); match {
+			return true
+		}
+	}
+	return false
+}
+
+// removeQueryParam removes the parameter from the raw query string, leaving the other
+// parameters as they are.
+func removeQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestAPIKey(t *testing.T) {
+	consumers := NewConsumers([]config.Consumer{
+		{Name: "mobile", Keys: []string{hashKey("mobile-key"), hashKey("mobile-key-2")}, Metadata: map[string]string{"team": "apps"}},
+		{Name: "billing", Keys: []string{hashKey("billing-key")}, Endpoints: []string{"api.example.com/invoices/*"}},
+		{Name: "partner", Keys: []string{hashKey("partner-key")}, Vhosts: []string{"*.partners.example.com"}},
+	})
+	cfg := &config.APIKeyAuth{QueryParam: "api_key", ForwardHeader: "X-Consumer", ForwardMetadataPrefix: "X-Consumer-"}
+
+	tests := []struct {
+		name         string
+		target       string
+		key          string
+		wantStatus   int
+		wantConsumer string
+		wantQuery    string
+	}{
+		{name: "header", target: "/users/1?page=2", key: "mobile-key", wantStatus: http.StatusOK, wantConsumer: "mobile", wantQuery: "page=2"},
+		{name: "second key", target: "/users/1", key: "mobile-key-2", wantStatus: http.StatusOK, wantConsumer: "mobile"},
+		{name: "query", target: "/users/1?page=2&api_key=mobile-key&sort=asc", wantStatus: http.StatusOK, wantConsumer: "mobile", wantQuery: "page=2&sort=asc"},
+		{name: "missing", target: "/users/1", wantStatus: http.StatusUnauthorized},
+		{name: "unknown", target: "/users/1", key: "nope", wantStatus: http.StatusUnauthorized},
+		{name: "endpoint not allowed", target: "/users/1", key: "billing-key", wantStatus: http.StatusForbidden},
+		{name: "vhost not allowed", target: "/users/1", key: "partner-key", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backend *http.Request
+			handler := APIKey(cfg, consumers, "api.example.com", "/users/{id}")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				backend = r
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("X-Consumer", "forged")
+			req.Header.Set("X-Consumer-Team", "forged")
+			req.Header.Set("X-Consumer-Role", "admin")
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if backend == nil {
+				return
+			}
+			consumer, ok := ConsumerFromContext(backend.Context())
+			if !ok || consumer.Name != tt.wantConsumer {
+				t.Errorf("ConsumerFromContext() = %v, want %s", consumer, tt.wantConsumer)
+			}
+			if got := backend.Header.Get("X-Consumer"); got != tt.wantConsumer {
+				t.Errorf("X-Consumer = %q, want %q", got, tt.wantConsumer)
+			}
+			if got := backend.Header.Get("X-Consumer-Team"); got != "apps" {
+				t.Errorf("X-Consumer-Team = %q, want %q", got, "apps")
+			}
+			if got := backend.Header.Get("X-Consumer-Role"); got != "" {
+				t.Errorf("X-Consumer-Role = %q, want it removed", got)
+			}
+			if got := backend.Header.Get("X-API-Key"); got != "" {
+				t.Errorf("X-API-Key = %q, want it removed", got)
+			}
+			if backend.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", backend.URL.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestAllowedEndpoints(t *testing.T) {
+	consumer := &config.Consumer{Endpoints: []string{"api.example.com/users/{id}"}}
+	if !allowed(consumer, "api.example.com", "/users/{id}") {
+		t.Error("allowed() = false for an endpoint listed with its path template, want true")
+	}
+	if allowed(consumer, "api.example.com", "/users") {
+		t.Error("allowed() = true for an endpoint not listed, want false")
+	}
+}
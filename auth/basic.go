@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// defaultRealm is the realm announced by the Basic authentication challenge by default.
+	defaultRealm = "Restricted"
+	// dummyHash is compared with the passwords of unknown users, so that they take as long
+	// to reject as the ones of known users, and users cannot be enumerated by timing.
+	dummyHash = "$2a$10$U2CnPDAHQVI0QHat.gU6EepbMVqUz3HAYI6EJzFOKQoyMLsGwSIV."
+)
+
+// Htpasswd holds the users of an htpasswd file, mapped to their password hashes.
+type Htpasswd struct {
+	users map[string]string
+}
+
+// ReadHtpasswd reads an htpasswd file. Passwords must be hashed with bcrypt, SHA-1 or APR1-MD5.
+func ReadHtpasswd(file string) (*Htpasswd, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &Htpasswd{users: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: malformed entry", file, line)
+		}
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash of user %s", file, line, user)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate reports whether the password of the user matches.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, apr1Magic), "$")
+		return constantTimeEqual(apr1(password, salt), hash)
+	default:
+		return false
+	}
+}
+
+// BasicAuth returns a middleware authenticating the requests with the users of the htpasswd
+// file. Requests without valid credentials are rejected with a 401 Unauthorized and a
+// challenge for the realm. The credentials are not forwarded to the backends.
+func BasicAuth(cfg *config.BasicAuth, users *Htpasswd) func(http.Handler) http.Handler {
+	realm := cfg.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !users.Authenticate(user, password) {
+				if ok {
+					logger.FromContext(r.Context()).WithField(logger.FieldUser, user).Info("Basic authentication rejected")
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			logger.RecordUser(r.Context(), user)
+			r.Header.Del("Authorization")
+			if cfg.ForwardHeader != "" {
+				r.Header.Set(cfg.ForwardHeader, user)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, apr1Magic)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// apr1Magic prefixes the APR1-MD5 password hashes.
+const apr1Magic = "$apr1$"
+
+// apr1 hashes the password with the salt using the APR1-MD5 algorithm of Apache, a variant
+// of the MD5-based crypt of FreeBSD.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write(s)
+	alternate.Write(pw)
+	final := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write(s)
+	for n := len(pw); n > 0; n -= 16 {
+		ctx.Write(final[:min(n, 16)])
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final = ctx.Sum(nil)
+
+	// Slow the hash down, as the algorithm prescribes.
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write(s)
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	encoded := make([]byte, 0, 22)
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded = append(encoded, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(uint32(final[0])<<16|uint32(final[6])<<8|uint32(final[12]), 4)
+	encode(uint32(final[1])<<16|uint32(final[7])<<8|uint32(final[13]), 4)
+	encode(uint32(final[2])<<16|uint32(final[8])<<8|uint32(final[14]), 4)
+	encode(uint32(final[3])<<16|uint32(final[9])<<8|uint32(final[15]), 4)
+	encode(uint32(final[4])<<16|uint32(final[10])<<8|uint32(final[5]), 4)
+	encode(uint32(final[11]), 2)
+
+	return apr1Magic + salt + "$" + string(encoded)
+}
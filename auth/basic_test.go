@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApr1(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{password: "myPassword", salt: "r31.....", want: "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{password: "secret", salt: "8sFt66rZ", want: "$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := apr1(tt.password, tt.salt); got != tt.want {
+				t.Errorf("apr1() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeHtpasswd(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), ".htpasswd")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return file
+}
+
+func TestBasicAuth(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	file := writeHtpasswd(t, "# Internal tools\n"+
+		"alice:"+string(bcryptHash)+"\n"+
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+		"carol:$apr1$8sFt66rZ$eup.HOtZcQ/VrnApBM3rR/\n")
+	users, err := ReadHtpasswd(file)
+	if err != nil {
+		t.Fatalf("ReadHtpasswd() error = %v", err)
+	}
+	cfg := &config.BasicAuth{HtpasswdFile: file, Realm: "Tools", ForwardHeader: "X-User"}
+
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		wantStatus int
+	}{
+		{name: "bcrypt", user: "alice", password: "secret", wantStatus: http.StatusOK},
+		{name: "sha", user: "bob", password: "secret", wantStatus: http.StatusOK},
+		{name: "apr1", user: "carol", password: "secret", wantStatus: http.StatusOK},
+		{name: "wrong password", user: "alice", password: "nope", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", user: "mallory", password: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded, authorization string
+			handler := BasicAuth(cfg, users)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = r.Header.Get("X-User")
+				authorization = r.Header.Get("Authorization")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-User", "forged")
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if got, want := rec.Header().Get("WWW-Authenticate"), `Basic realm="Tools", charset="UTF-8"`; got != want {
+					t.Errorf("WWW-Authenticate = %s, want %s", got, want)
+				}
+			} else {
+				if forwarded != tt.user {
+					t.Errorf("X-User = %q, want %q", forwarded, tt.user)
+				}
+				if authorization != "" {
+					t.Errorf("Authorization = %q, want it removed", authorization)
+				}
+			}
+		})
+	}
+}
+
+func TestReadHtpasswdErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "malformed", content: "alice\n"},
+		{name: "plain text password", content: "alice:secret\n"},
+		{name: "crypt", content: "alice:rl0uTZ8w/Wq6Q\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadHtpasswd(writeHtpasswd(t, tt.content)); err == nil {
+				t.Error("ReadHtpasswd() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnknownUser(t *testing.T) {
+	if _, err := bcrypt.Cost([]byte(dummyHash)); err != nil {
+		t.Fatalf("dummyHash is not a bcrypt hash: %v", err)
+	}
+	users := &Htpasswd{users: map[string]string{}}
+	if users.Authenticate("mallory", "gateh8 dummy password") {
+		t.Error("Authenticate() = true for an unknown user, want false")
+	}
+}
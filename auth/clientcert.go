@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// verifiedCertKey is the context key of the client certificate verified against the CAs
+// of the vhost serving a request.
+var verifiedCertKey = &contextKey{"verifiedCert"}
+
+// ReadClientCAs reads the PEM bundle of the CAs the client certificates are verified against.
+func ReadClientCAs(file string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return roots, nil
+}
+
+// ClientAuth returns a middleware enforcing the client certificate mode of a vhost, and
+// forwarding the details of the client certificates to the backends. The mode is already
+// enforced by the TLS handshake, but against the settings of the vhost named by the client
+// in the handshake, which may differ from the one it sends its requests to, for instance
+// on an HTTP/2 connection established for another vhost. The client certificates are
+// therefore verified again against the CAs of the vhost, roots, and the requests without
+// the certificate the vhost requires are rejected with a 421 Misdirected Request, so that
+// they are retried on a new connection. Headers named after forwarded details cannot be
+// forged by the clients.
+func ClientAuth(cfg *config.ClientAuth, roots *x509.CertPool) func(http.Handler) http.Handler {
+	headers := cfg.ForwardHeaders
+	if headers == nil {
+		headers = &config.ClientCertHeaders{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var cert *x509.Certificate
+			if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				cert = r.TLS.PeerCertificates[0]
+			}
+			verified := cert != nil && roots != nil && verifyClientCert(r.TLS.PeerCertificates, roots)
+
+			misdirected := false
+			switch cfg.Mode {
+			case config.ClientAuthRequest:
+				misdirected = cert != nil && roots != nil && !verified
+			case config.ClientAuthRequire:
+				misdirected = cert == nil
+			case config.ClientAuthVerify:
+				misdirected = !verified
+			}
+			if misdirected {
+				logger.FromContext(r.Context()).Info("Request without the client certificate required by the vhost")
+				http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+				return
+			}
+
+			forward := func(header, value string) {
+				if header == "" {
+					return
+				}
+				r.Header.Del(header)
+				if cert != nil {
+					r.Header.Set(header, value)
+				}
+			}
+			var subject, sans, fingerprint, escaped string
+			if cert != nil {
+				sum := sha256.Sum256(cert.Raw)
+				subject = cert.Subject.String()
+				sans = strings.Join(subjectAltNames(cert), ", ")
+				fingerprint = hex.EncodeToString(sum[:])
+				escaped = url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+			}
+			forward(headers.Subject, subject)
+			forward(headers.SANs, sans)
+			forward(headers.Fingerprint, fingerprint)
+			forward(headers.Cert, escaped)
+
+			if verified {
+				r = r.WithContext(context.WithValue(r.Context(), verifiedCertKey, cert))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifyClientCert reports whether the certificate chain presented by a client is signed
+// by one of the CAs, like the TLS handshake verifies it.
+func verifyClientCert(chain []*x509.Certificate, roots *x509.CertPool) bool {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// ClientCert returns a middleware restricting an endpoint to the clients with a certificate
+// verified against the CAs of its vhost by ClientAuth, and allowed by the policy. Other
+// requests are rejected with a 403 Forbidden. The common name of the certificate is logged
+// as the user of the request.
+func ClientCert(policy *config.ClientCertPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.FromContext(r.Context())
+			cert, ok := r.Context().Value(verifiedCertKey).(*x509.Certificate)
+			if !ok {
+				log.Info("Request without a verified client certificate")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			if !certAllowed(policy, cert) {
+				log.WithField("subject", cert.Subject.String()).Info("Client certificate not allowed on the endpoint")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			logger.RecordUser(r.Context(), cert.Subject.CommonName)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// certAllowed reports whether the subject of the certificate, or its common name, matches
+// one of the allowed subjects, or whether one of its subject alternative names matches one
+// of the allowed SANs.
+func certAllowed(policy *config.ClientCertPolicy, cert *x509.Certificate) bool {
+	if len(policy.AllowedSubjects) == 0 && len(policy.AllowedSANs) == 0 {
+		return true
+	}
+	for _, pattern := range policy.AllowedSubjects {
+		if matchPattern(pattern, cert.Subject.String()) || matchPattern(pattern, cert.Subject.CommonName) {
+			return true
+		}
+	}
+	for _, pattern := range policy.AllowedSANs {
+		for _, san := range subjectAltNames(cert) {
+			// The names are matched with or without their type, such as DNS:.
+			_, value, _ := strings.Cut(san, ":")
+			if matchPattern(pattern, san) || matchPattern(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, value string) bool {
+	if value == "" {
+		return false
+	}
+	match, _ := filepath.Match(pattern, value)
+	return match
+}
+
+// subjectAltNames returns the subject alternative names of the certificate, prefixed with
+// their type like OpenSSL does: DNS:, email:, IP: or URI:.
+func subjectAltNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	return names
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/yarlson/GateH8/config"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return &testCA{cert: createCert(t, template, template, key, key), key: key}
+}
+
+// roots returns a pool holding the certificate of the CA.
+func (ca *testCA) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue creates a client certificate for the common name and the DNS names.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Acme"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return createCert(t, template, ca.cert, key, ca.key)
+}
+
+func createCert(t *testing.T, template, parent *x509.Certificate, key, signer *ecdsa.PrivateKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return cert
+}
+
+// serveClientCert serves a request over a connection with the client certificate through
+// the middleware, and returns the response along with the headers the backend received.
+// The connection claims the certificate was verified during the handshake, as it would
+// be against the CAs of the vhost named in the handshake.
+func serveClientCert(middleware func(http.Handler) http.Handler, cert *x509.Certificate, headers map[string]string) (*httptest.ResponseRecorder, http.Header) {
+	var received http.Header
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "https://api.example.com/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, received
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t, "Acme CA")
+	other := newTestCA(t, "Other CA")
+	cert := ca.issue(t, "alice", "alice.example.com")
+	// A certificate of another vhost's CA, verified by the handshake of that vhost.
+	foreign := other.issue(t, "mallory")
+
+	tests := []struct {
+		name       string
+		mode       string
+		roots      *x509.CertPool
+		cert       *x509.Certificate
+		wantStatus int
+	}{
+		{name: "request without certificate", mode: config.ClientAuthRequest, roots: ca.roots(), wantStatus: http.StatusOK},
+		{name: "request", mode: config.ClientAuthRequest, roots: ca.roots(), cert: cert, wantStatus: http.StatusOK},
+		{name: "request with foreign certificate", mode: config.ClientAuthRequest, roots: ca.roots(), cert: foreign, wantStatus: http.StatusMisdirectedRequest},
+		{name: "request without CAs", mode: config.ClientAuthRequest, cert: foreign, wantStatus: http.StatusOK},
+		{name: "require", mode: config.ClientAuthRequire, cert: foreign, wantStatus: http.StatusOK},
+		{name: "require without certificate", mode: config.ClientAuthRequire, wantStatus: http.StatusMisdirectedRequest},
+		{name: "verify", mode: config.ClientAuthVerify, roots: ca.roots(), cert: cert, wantStatus: http.StatusOK},
+		{name: "verify without certificate", mode: config.ClientAuthVerify, roots: ca.roots(), wantStatus: http.StatusMisdirectedRequest},
+		{name: "verify with foreign certificate", mode: config.ClientAuthVerify, roots: ca.roots(), cert: foreign, wantStatus: http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := serveClientCert(ClientAuth(&config.ClientAuth{Mode: tt.mode}, tt.roots), tt.cert, nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestClientAuthForwardHeaders(t *testing.T) {
+	ca := newTestCA(t, "Acme CA")
+	cert := ca.issue(t, "alice", "alice.example.com")
+	middleware := ClientAuth(&config.ClientAuth{
+		Mode: config.ClientAuthRequest,
+		ForwardHeaders: &config.ClientCertHeaders{
+			Subject:     "X-Client-Subject",
+			SANs:        "X-Client-SANs",
+			Fingerprint: "X-Client-Fingerprint",
+			Cert:        "X-Client-Cert",
+		},
+	}, ca.roots())
+
+	_, received := serveClientCert(middleware, cert, nil)
+	sum := sha256.Sum256(cert.Raw)
+	want := map[string]string{
+		"X-Client-Subject":     "CN=alice,O=Acme",
+		"X-Client-SANs":        "DNS:alice.example.com",
+		"X-Client-Fingerprint": hex.EncodeToString(sum[:]),
+	}
+	for header, value := range want {
+		if got := received.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+	unescaped, err := url.QueryUnescape(received.Get("X-Client-Cert"))
+	if err != nil {
+		t.Fatalf("QueryUnescape() error = %v", err)
+	}
+	if block, _ := pem.Decode([]byte(unescaped)); block == nil || string(block.Bytes) != string(cert.Raw) {
+		t.Errorf("X-Client-Cert = %q, want the PEM of the certificate", received.Get("X-Client-Cert"))
+	}
+
+	// Without a certificate, the headers sent by the client are removed.
+	_, received = serveClientCert(middleware, nil, map[string]string{"X-Client-Subject": "CN=admin"})
+	if got := received.Get("X-Client-Subject"); got != "" {
+		t.Errorf("X-Client-Subject = %q, want it removed", got)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	ca := newTestCA(t, "Acme CA")
+	other := newTestCA(t, "Other CA")
+	alice := ca.issue(t, "alice", "alice.example.com")
+	bob := ca.issue(t, "bob", "bob.internal")
+	// Same subject, but issued by the CA of another vhost.
+	forgedAlice := other.issue(t, "alice", "alice.example.com")
+
+	tests := []struct {
+		name       string
+		mode       string
+		policy     config.ClientCertPolicy
+		cert       *x509.Certificate
+		wantStatus int
+	}{
+		{name: "any verified certificate", cert: bob, wantStatus: http.StatusOK},
+		{name: "no certificate", wantStatus: http.StatusForbidden},
+		{name: "subject", policy: config.ClientCertPolicy{AllowedSubjects: []string{"CN=alice,O=Acme"}}, cert: alice, wantStatus: http.StatusOK},
+		{name: "common name pattern", policy: config.ClientCertPolicy{AllowedSubjects: []string{"ali*"}}, cert: alice, wantStatus: http.StatusOK},
+		{name: "other subject", policy: config.ClientCertPolicy{AllowedSubjects: []string{"CN=alice,*"}}, cert: bob, wantStatus: http.StatusForbidden},
+		{name: "SAN pattern", policy: config.ClientCertPolicy{AllowedSANs: []string{"*.internal"}}, cert: bob, wantStatus: http.StatusOK},
+		{name: "typed SAN", policy: config.ClientCertPolicy{AllowedSANs: []string{"DNS:alice.example.com"}}, cert: alice, wantStatus: http.StatusOK},
+		{name: "other SAN", policy: config.ClientCertPolicy{AllowedSANs: []string{"*.internal"}}, cert: alice, wantStatus: http.StatusForbidden},
+		{name: "subject of another CA", mode: config.ClientAuthVerify, policy: config.ClientCertPolicy{AllowedSubjects: []string{"CN=alice,O=Acme"}}, cert: forgedAlice, wantStatus: http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := tt.mode
+			if mode == "" {
+				mode = config.ClientAuthRequest
+			}
+			policy := tt.policy
+			middleware := func(next http.Handler) http.Handler {
+				return ClientAuth(&config.ClientAuth{Mode: mode}, ca.roots())(ClientCert(&policy)(next))
+			}
+			rec, _ := serveClientCert(middleware, tt.cert, nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	// Certificates are only trusted once verified against the CAs of the vhost.
+	rec, _ := serveClientCert(ClientCert(&config.ClientCertPolicy{}), alice, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status without ClientAuth = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestReadClientCAs(t *testing.T) {
+	ca := newTestCA(t, "Acme CA")
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "bundle", file: bundle},
+		{name: "no certificate", file: empty, wantErr: true},
+		{name: "missing", file: filepath.Join(dir, "missing.pem"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadClientCAs(tt.file); (err != nil) != tt.wantErr {
+				t.Errorf("ReadClientCAs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/yarlson/GateH8/logger"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksTimeout bounds the time spent fetching a JWKS.
+	jwksTimeout = 10 * time.Second
+	// jwksMinRefresh is the minimum interval between two fetches of a JWKS, so that
+	// tokens signed with unknown keys cannot make the gateway hammer the JWKS URL.
+	jwksMinRefresh = 10 * time.Second
+)
+
+// jwksCache fetches the keys of a JSON Web Key Set and caches them. The set is fetched
+// again once its refresh interval elapsed, or when a token is signed with an unknown key.
+// The cached keys are kept when a fetch fails.
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetched     time.Time
+	lastAttempt time.Time
+	// refreshing is closed once the fetch in progress, if any, completes.
+	refreshing chan struct{}
+}
+
+func newJWKSCache(url string, refresh time.Duration) *jwksCache {
+	return &jwksCache{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// get returns the key with the given ID, or all the keys of the set if kid is empty.
+// Cached keys are returned right away, even while the set is being refreshed. Only the
+// callers looking for a key that is not cached wait for the refresh, which is shared by
+// all of them.
+func (c *jwksCache) get(kid string) []crypto.PublicKey {
+	c.mu.Lock()
+	_, known := c.keys[kid]
+	if kid == "" {
+		known = len(c.keys) > 0
+	}
+	now := time.Now()
+	stale := now.Sub(c.fetched) >= c.refresh || !known
+	if stale && c.refreshing == nil && now.Sub(c.lastAttempt) >= jwksMinRefresh {
+		c.lastAttempt = now
+		c.refreshing = make(chan struct{})
+		go c.update(c.refreshing)
+	}
+	refreshing := c.refreshing
+	c.mu.Unlock()
+
+	if !known && refreshing != nil {
+		<-refreshing
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if kid != "" {
+		if key, ok := c.keys[kid]; ok {
+			return []crypto.PublicKey{key}
+		}
+		return nil
+	}
+	keys := make([]crypto.PublicKey, 0, len(c.keys))
+	for _, key := range c.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// update fetches the set and caches its keys, then closes the refreshing channel.
+func (c *jwksCache) update(refreshing chan struct{}) {
+	keys, err := c.fetch()
+	if err != nil {
+		logger.L.WithError(err).WithField("url", c.url).Error("Error fetching JWKS")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.keys = keys
+		c.fetched = time.Now()
+	}
+	c.refreshing = nil
+	close(refreshing)
+}
+
+// jwk is a JSON Web Key, with the parameters of the supported key types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch downloads the key set. Keys that are not meant for signatures, or of unsupported
+// types, are ignored. Keys without an ID are indexed by their position in the set.
+func (c *jwksCache) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes the public key of the JWK.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
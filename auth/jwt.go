@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultJWKSRefresh is how long the keys fetched from a JWKS URL are cached by default.
+const defaultJWKSRefresh = time.Hour
+
+// errInsufficientScope is returned for valid tokens that lack a required scope or claim.
+var errInsufficientScope = errors.New("insufficient scope")
+
+// JWT authenticates requests with the JSON Web Tokens they present.
+type JWT struct {
+	cfg    *config.JWT
+	parser *jwt.Parser
+	secret []byte
+	keys   []crypto.PublicKey
+	jwks   *jwksCache
+}
+
+// NewJWT creates a JWT authenticator from the configuration. Key files are read once,
+// while the keys of the JWKS URL are fetched on first use and cached.
+func NewJWT(cfg *config.JWT) (*JWT, error) {
+	j := &JWT{cfg: cfg, secret: []byte(cfg.Secret)}
+	for _, file := range cfg.KeyFiles {
+		keys, err := readPublicKeys(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JWT keys from %s: %w", file, err)
+		}
+		j.keys = append(j.keys, keys...)
+	}
+	if cfg.JWKSURL != "" {
+		j.jwks = newJWKSCache(cfg.JWKSURL, cfg.JWKSRefresh.Or(defaultJWKSRefresh))
+	}
+
+	algorithms := cfg.Algorithms
+	if len(algorithms) == 0 {
+		if cfg.Secret != "" {
+			algorithms = append(algorithms, config.JWTHMACAlgorithms...)
+		}
+		if len(cfg.KeyFiles) > 0 || cfg.JWKSURL != "" {
+			algorithms = append(algorithms, config.JWTAsymmetricAlgorithms...)
+		}
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(cfg.Leeway)),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if len(cfg.Audience) > 0 {
+		options = append(options, jwt.WithAudience(cfg.Audience...))
+	}
+	j.parser = jwt.NewParser(options...)
+	return j, nil
+}
+
+// Middleware rejects the requests without a valid token with a 401 Unauthorized, and the
+// ones whose token lacks a required scope or claim with a 403 Forbidden. The configured
+// claims of accepted tokens are forwarded to the backend as headers.
+func (j *JWT) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := j.authenticate(r)
+		if err != nil {
+			logger.FromContext(r.Context()).WithError(err).Info("JWT rejected")
+			if errors.Is(err, errInsufficientScope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if sub, _ := claims["sub"].(string); sub != "" {
+			logger.RecordUser(r.Context(), sub)
+		}
+		for claim, header := range j.cfg.ForwardClaims {
+			r.Header.Del(header)
+			if value, ok := claims[claim]; ok {
+				r.Header.Set(header, claimString(value))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate validates the token of the request and returns its claims.
+func (j *JWT) authenticate(r *http.Request) (jwt.MapClaims, error) {
+	raw := j.token(r)
+	if raw == "" {
+		return nil, errors.New("no token")
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := j.parser.ParseWithClaims(raw, claims, j.keyfunc); err != nil {
+		return nil, err
+	}
+
+	for claim, want := range j.cfg.RequiredClaims {
+		value, ok := claims[claim]
+		if !ok || (want != "" && !slices.Contains(claimValues(value), want)) {
+			return nil, fmt.Errorf("%w: claim %s", errInsufficientScope, claim)
+		}
+	}
+	if len(j.cfg.Scopes) > 0 {
+		granted := scopes(claims)
+		for _, scope := range j.cfg.Scopes {
+			if !slices.Contains(granted, scope) {
+				return nil, fmt.Errorf("%w: scope %s", errInsufficientScope, scope)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// token returns the token presented by the request, from the first configured source it is found in.
+func (j *JWT) token(r *http.Request) string {
+	header := j.cfg.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	if value := r.Header.Get(header); value != "" {
+		if len(value) > len("Bearer ") && strings.EqualFold(value[:len("Bearer ")], "Bearer ") {
+			return value[len("Bearer "):]
+		}
+		return value
+	}
+	if j.cfg.QueryParam != "" {
+		if value := r.URL.Query().Get(j.cfg.QueryParam); value != "" {
+			return value
+		}
+	}
+	if j.cfg.Cookie != "" {
+		if cookie, err := r.Cookie(j.cfg.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// keyfunc returns the keys that may have signed the token, depending on its algorithm.
+func (j *JWT) keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(j.secret) == 0 {
+			return nil, errors.New("no secret configured")
+		}
+		return j.secret, nil
+	}
+
+	candidates := j.keys
+	if j.jwks != nil {
+		kid, _ := token.Header["kid"].(string)
+		candidates = append(slices.Clip(candidates), j.jwks.get(kid)...)
+	}
+
+	set := jwt.VerificationKeySet{}
+	for _, key := range candidates {
+		if keyMatches(token.Method, key) {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no key for algorithm %s", token.Method.Alg())
+	}
+	return set, nil
+}
+
+// keyMatches reports whether the key has the type expected by the signing method.
+func keyMatches(method jwt.SigningMethod, key crypto.PublicKey) bool {
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodEd25519:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+// readPublicKeys reads the public keys and certificates of a PEM file.
+func readPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// scopes returns the scopes granted to a token, listed in its scope claim (space-separated)
+// or its scp claim (a string or an array).
+func scopes(claims jwt.MapClaims) []string {
+	var granted []string
+	for _, claim := range []string{"scope", "scp"} {
+		for _, value := range claimValues(claims[claim]) {
+			granted = append(granted, strings.Fields(value)...)
+		}
+	}
+	return granted
+}
+
+// claimValues returns the value of a claim as strings: one per element for arrays.
+func claimValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			values = append(values, claimString(element))
+		}
+		return values
+	default:
+		return []string{claimString(v)}
+	}
+}
+
+// claimString formats the value of a claim as a header value: strings are kept as they
+// are, and other values are encoded as JSON.
+func claimString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yarlson/GateH8/config"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveJWT serves a request with the token through the JWT middleware, and returns the
+// response along with the headers the backend received.
+func serveJWT(t *testing.T, j *JWT, token string, headers http.Header) (*httptest.ResponseRecorder, http.Header) {
+	var received http.Header
+	handler := j.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, received
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":    "user-1",
+		"iss":    "https://issuer.example.com",
+		"aud":    "gateh8",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"scope":  "read write",
+		"tenant": "acme",
+		"roles":  []string{"admin", "dev"},
+	}
+}
+
+func withClaims(overrides jwt.MapClaims) jwt.MapClaims {
+	claims := validClaims()
+	for key, value := range overrides {
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+	}
+	return claims
+}
+
+func TestJWTHMAC(t *testing.T) {
+	secret := []byte("secret")
+	j, err := NewJWT(&config.JWT{
+		Secret:         string(secret),
+		Issuer:         "https://issuer.example.com",
+		Audience:       []string{"gateh8", "other"},
+		RequiredClaims: map[string]string{"tenant": "acme", "roles": "admin"},
+		Scopes:         []string{"read"},
+		ForwardClaims:  map[string]string{"sub": "X-User", "roles": "X-Roles"},
+	})
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "valid", token: sign(t, jwt.SigningMethodHS256, secret, "", validClaims()), wantStatus: http.StatusOK},
+		{name: "missing", token: "", wantStatus: http.StatusUnauthorized},
+		{name: "malformed", token: "not-a-jwt", wantStatus: http.StatusUnauthorized},
+		{name: "wrong secret", token: sign(t, jwt.SigningMethodHS256, []byte("nope"), "", validClaims()), wantStatus: http.StatusUnauthorized},
+		{name: "expired", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), wantStatus: http.StatusUnauthorized},
+		{name: "no expiry", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"exp": nil})), wantStatus: http.StatusUnauthorized},
+		{name: "not yet valid", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"nbf": time.Now().Add(time.Minute).Unix()})), wantStatus: http.StatusUnauthorized},
+		{name: "wrong issuer", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"iss": "https://evil.example.com"})), wantStatus: http.StatusUnauthorized},
+		{name: "other audience", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"aud": []string{"other"}})), wantStatus: http.StatusOK},
+		{name: "wrong audience", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"aud": "billing"})), wantStatus: http.StatusUnauthorized},
+		{name: "missing scope", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"scope": "write"})), wantStatus: http.StatusForbidden},
+		{name: "scp claim", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"scope": nil, "scp": []string{"read"}})), wantStatus: http.StatusOK},
+		{name: "wrong claim value", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"tenant": "globex"})), wantStatus: http.StatusForbidden},
+		{name: "missing claim", token: sign(t, jwt.SigningMethodHS256, secret, "", withClaims(jwt.MapClaims{"roles": nil})), wantStatus: http.StatusForbidden},
+		{name: "algorithm none", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", validClaims()), wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := serveJWT(t, j, tt.token, nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWTForwardClaims(t *testing.T) {
+	secret := []byte("secret")
+	j, err := NewJWT(&config.JWT{
+		Secret:        string(secret),
+		ForwardClaims: map[string]string{"sub": "X-User", "roles": "X-Roles", "email": "X-Email"},
+	})
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+
+	// Headers named after forwarded claims cannot be forged by the client.
+	forged := http.Header{"X-Email": {"admin@example.com"}}
+	rec, received := serveJWT(t, j, sign(t, jwt.SigningMethodHS256, secret, "", validClaims()), forged)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	want := map[string]string{"X-User": "user-1", "X-Roles": `["admin","dev"]`, "X-Email": ""}
+	for header, value := range want {
+		if got := received.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestJWTKeyFiles(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	dir := t.TempDir()
+	rsaFile := writePublicKey(t, dir, "rsa.pem", &rsaKey.PublicKey)
+	edFile := writePublicKey(t, dir, "ed25519.pem", edPublic)
+
+	j, err := NewJWT(&config.JWT{KeyFiles: []string{rsaFile, edFile}})
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "RS256", token: sign(t, jwt.SigningMethodRS256, rsaKey, "", validClaims()), wantStatus: http.StatusOK},
+		{name: "PS256", token: sign(t, jwt.SigningMethodPS256, rsaKey, "", validClaims()), wantStatus: http.StatusOK},
+		{name: "EdDSA", token: sign(t, jwt.SigningMethodEdDSA, edPrivate, "", validClaims()), wantStatus: http.StatusOK},
+		{name: "unknown key", token: sign(t, jwt.SigningMethodRS256, otherKey, "", validClaims()), wantStatus: http.StatusUnauthorized},
+		// Without a secret, the public key cannot be abused as an HMAC secret.
+		{name: "HS256", token: sign(t, jwt.SigningMethodHS256, []byte("secret"), "", validClaims()), wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := serveJWT(t, j, tt.token, nil)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	if _, err := NewJWT(&config.JWT{KeyFiles: []string{filepath.Join(dir, "missing.pem")}}); err == nil {
+		t.Error("NewJWT() error = nil, want error for a missing key file")
+	}
+}
+
+func TestJWTJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotatedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var (
+		fetches atomic.Int32
+		rotated atomic.Bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []map[string]string{ecJWK("key-1", &ecKey.PublicKey)}
+		if rotated.Load() {
+			keys = append(keys, ecJWK("key-2", &rotatedKey.PublicKey))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	j, err := NewJWT(&config.JWT{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec, _ := serveJWT(t, j, sign(t, jwt.SigningMethodES256, ecKey, "key-1", validClaims()), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+
+	// A token signed with an unknown key triggers a refresh, at most every jwksMinRefresh.
+	rotated.Store(true)
+	j.jwks.lastAttempt = time.Time{}
+	rec, _ := serveJWT(t, j, sign(t, jwt.SigningMethodES256, rotatedKey, "key-2", validClaims()), nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status with rotated key = %d, want %d", rec.Code, http.StatusOK)
+	}
+	rec, _ = serveJWT(t, j, sign(t, jwt.SigningMethodES256, rotatedKey, "key-3", validClaims()), nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status with unknown key = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+}
+
+func writePublicKey(t *testing.T, dir, name string, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return file
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	return map[string]string{"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256", "x": encode(key.X), "y": encode(key.Y)}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch but the first one hangs until released.
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{ecJWK("key-1", &ecKey.PublicKey)}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := newJWKSCache(server.URL, time.Hour)
+	if keys := c.get("key-1"); len(keys) != 1 {
+		t.Fatalf("get(key-1) = %d keys, want 1", len(keys))
+	}
+
+	// A refresh of an expired set does not hold up the tokens signed with a cached key.
+	c.mu.Lock()
+	c.fetched, c.lastAttempt = time.Time{}, time.Time{}
+	c.mu.Unlock()
+	got := make(chan int)
+	go func() {
+		got <- len(c.get("key-1"))
+	}()
+	select {
+	case n := <-got:
+		if n != 1 {
+			t.Errorf("get(key-1) during refresh = %d keys, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get(key-1) blocked on the refresh")
+	}
+
+	// Concurrent lookups of an unknown key share the refresh in progress.
+	for i := 0; i < 5; i++ {
+		go func() {
+			got <- len(c.get("key-2"))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	for i := 0; i < 5; i++ {
+		if n := <-got; n != 0 {
+			t.Errorf("get(key-2) = %d keys, want 0", n)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
@@ -1,6 +1,9 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -11,16 +14,67 @@ type HttpProxyClient struct {
 }
 
 // NewHttpProxyClient initializes a new HttpProxyClient with an HTTPClient and a logger.
+// The default HTTP client is used when client is nil.
 func NewHttpProxyClient(client *http.Client) *HttpProxyClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
 	return &HttpProxyClient{
 		client: client,
 	}
 }
 
 // Execute sends the HTTP request to the backend and returns the response.
-// It uses a client with a timeout.
+// The timeout bounds the wait for the response headers only, so that streamed
+// response bodies can be relayed for as long as the backend keeps sending them.
 func (pc *HttpProxyClient) Execute(req *http.Request, timeout time.Duration) (*http.Response, error) {
-	// Business Logic: Create a new client with a timeout and execute the request
-	clientWithTimeout := &http.Client{Timeout: timeout}
-	return clientWithTimeout.Do(req)
+	if timeout <= 0 {
+		return pc.client.Do(req)
+	}
+
+	// Business Logic: Cancel the request if the headers do not arrive in time
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+
+	resp, err := pc.client.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer fired: the request was cancelled because of the timeout.
+		cancel()
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return nil, &timeoutError{timeout: timeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// timeoutError is returned by Execute when the backend did not answer in time.
+// It implements net.Error so that it is classified as a timeout.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timeout awaiting response headers after %s", e.timeout)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// cancelOnClose releases the context of a request once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
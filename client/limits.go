@@ -0,0 +1,139 @@
+package client
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/yarlson/GateH8/config"
+	"io"
+	"math"
+	"time"
+)
+
+// Close codes sent to clients exceeding the message limits, unless configured otherwise.
+const (
+	defaultMessageTooBigCloseCode = websocket.CloseMessageTooBig
+	defaultRateLimitCloseCode     = websocket.ClosePolicyViolation
+)
+
+// limitError is returned when a client exceeds one of the message limits of its endpoint.
+type limitError struct {
+	code   int
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// messageLimiter enforces the message size and rate limits of a single connection.
+// It must only be used from the goroutine reading the connection. A nil limiter lets
+// everything through.
+type messageLimiter struct {
+	maxSize      int64
+	messages     *tokenBucket
+	bytes        *tokenBucket
+	tooBigCode   int
+	rateLimitErr *limitError
+}
+
+// newMessageLimiter creates the limiter of a connection, or nil if no limit is configured.
+func newMessageLimiter(limits *config.WebSocketLimits) *messageLimiter {
+	if limits == nil || (limits.MaxMessageSize <= 0 && limits.MessagesPerSecond <= 0 && limits.BytesPerSecond <= 0) {
+		return nil
+	}
+
+	l := &messageLimiter{
+		maxSize:    limits.MaxMessageSize,
+		tooBigCode: limits.MessageTooBigCloseCode,
+		rateLimitErr: &limitError{
+			code:   limits.RateLimitCloseCode,
+			reason: "rate limit exceeded",
+		},
+	}
+	if l.tooBigCode == 0 {
+		l.tooBigCode = defaultMessageTooBigCloseCode
+	}
+	if l.rateLimitErr.code == 0 {
+		l.rateLimitErr.code = defaultRateLimitCloseCode
+	}
+	if limits.MessagesPerSecond > 0 {
+		l.messages = newTokenBucket(limits.MessagesPerSecond)
+	}
+	if limits.BytesPerSecond > 0 {
+		l.bytes = newTokenBucket(limits.BytesPerSecond)
+	}
+	return l
+}
+
+// readMessage reads the next message of the connection. Messages over the size limit are
+// not read past it, and are reported with a limitError, like messages over the rate limits.
+func (l *messageLimiter) readMessage(conn *websocket.Conn) (int, []byte, error) {
+	if l == nil || l.maxSize <= 0 {
+		messageType, message, err := conn.ReadMessage()
+		if err == nil {
+			err = l.allow(len(message))
+		}
+		return messageType, message, err
+	}
+
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, l.maxSize+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if int64(len(message)) > l.maxSize {
+		return messageType, nil, &limitError{code: l.tooBigCode, reason: "message too big"}
+	}
+	return messageType, message, l.allow(len(message))
+}
+
+// allow takes a message of the given size from the rate limits.
+func (l *messageLimiter) allow(size int) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	if l.messages != nil && !l.messages.take(1, now) {
+		return l.rateLimitErr
+	}
+	if l.bytes != nil && !l.bytes.take(float64(size), now) {
+		return l.rateLimitErr
+	}
+	return nil
+}
+
+// isLimitError reports whether the error was caused by a client exceeding its limits.
+func isLimitError(err error) (*limitError, bool) {
+	var limitErr *limitError
+	ok := errors.As(err, &limitErr)
+	return limitErr, ok
+}
+
+// tokenBucket is a token bucket refilled at a constant rate, holding up to one second worth of tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take removes n tokens from the bucket, if available. Requests larger than the bucket
+// are let through when it is full, leaving it in debt.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < math.Min(n, b.burst) {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/yarlson/GateH8/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		rate  float64
+		takes []float64
+		at    []time.Duration
+		want  []bool
+	}{
+		{
+			name:  "burst of one second",
+			rate:  2,
+			takes: []float64{1, 1, 1},
+			at:    []time.Duration{0, 0, 0},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			takes: []float64{2, 1, 1},
+			at:    []time.Duration{0, 100 * time.Millisecond, 500 * time.Millisecond},
+			want:  []bool{true, false, true},
+		},
+		{
+			name:  "larger than burst when full",
+			rate:  10,
+			takes: []float64{50, 1, 1},
+			at:    []time.Duration{0, time.Second, 5 * time.Second},
+			want:  []bool{true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate)
+			b.last = start
+			for i, n := range tt.takes {
+				if got := b.take(n, start.Add(tt.at[i])); got != tt.want[i] {
+					t.Errorf("take #%d = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketMessageLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   *config.WebSocketLimits
+		messages []string
+		wantCode int
+	}{
+		{
+			name:     "message too big",
+			limits:   &config.WebSocketLimits{MaxMessageSize: 4},
+			messages: []string{"abcd", "abcde"},
+			wantCode: websocket.CloseMessageTooBig,
+		},
+		{
+			name:     "messages per second",
+			limits:   &config.WebSocketLimits{MessagesPerSecond: 2, RateLimitCloseCode: 4008},
+			messages: []string{"a", "b", "c"},
+			wantCode: 4008,
+		},
+		{
+			name:     "bytes per second",
+			limits:   &config.WebSocketLimits{BytesPerSecond: 8},
+			messages: []string{"abcd", "abcd", "abcd"},
+			wantCode: websocket.ClosePolicyViolation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendCode := make(chan int, 1)
+			received := make(chan string, len(tt.messages))
+			url, returned := newTestRelay(t, NewSessions(), &config.WebSocketConfig{Limits: tt.limits}, func(conn *websocket.Conn) {
+				for {
+					_, message, err := conn.ReadMessage()
+					if err != nil {
+						if ce, ok := err.(*websocket.CloseError); ok {
+							backendCode <- ce.Code
+						}
+						return
+					}
+					received <- string(message)
+				}
+			})
+
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			for _, message := range tt.messages {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+					t.Fatalf("WriteMessage() error = %v", err)
+				}
+			}
+
+			_, _, err = conn.ReadMessage()
+			if !websocket.IsCloseError(err, tt.wantCode) {
+				t.Errorf("client ReadMessage() error = %v, want close code %d", err, tt.wantCode)
+			}
+			if code := <-backendCode; code != tt.wantCode {
+				t.Errorf("backend close code = %d, want %d", code, tt.wantCode)
+			}
+			<-returned
+
+			close(received)
+			var got []string
+			for message := range received {
+				got = append(got, message)
+			}
+			want := strings.Join(tt.messages[:len(tt.messages)-1], ",")
+			if strings.Join(got, ",") != want {
+				t.Errorf("relayed messages = %v, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSessionsAdmit(t *testing.T) {
+	sessions := NewSessions()
+
+	release, err := sessions.Admit("ws", "10.0.0.1", 2, 1)
+	if err != nil {
+		t.Fatalf("Admit() error = %v", err)
+	}
+	if _, err := sessions.Admit("ws", "10.0.0.1", 2, 1); err != ErrTooManyConnectionsPerIP {
+		t.Errorf("Admit() error = %v, want %v", err, ErrTooManyConnectionsPerIP)
+	}
+	if _, err := sessions.Admit("ws", "10.0.0.2", 2, 1); err != nil {
+		t.Errorf("Admit() error = %v", err)
+	}
+	if _, err := sessions.Admit("ws", "10.0.0.3", 2, 1); err != ErrTooManyConnections {
+		t.Errorf("Admit() error = %v, want %v", err, ErrTooManyConnections)
+	}
+	if _, err := sessions.Admit("other", "10.0.0.1", 2, 1); err != nil {
+		t.Errorf("Admit() on another endpoint error = %v", err)
+	}
+
+	release()
+	release()
+	if _, err := sessions.Admit("ws", "10.0.0.1", 2, 1); err != nil {
+		t.Errorf("Admit() after release error = %v", err)
+	}
+}
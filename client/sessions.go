@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooManyConnections is returned when an endpoint has reached its maximum number of connections.
+	ErrTooManyConnections = errors.New("too many WebSocket connections")
+	// ErrTooManyConnectionsPerIP is returned when a client has reached its maximum number of connections to an endpoint.
+	ErrTooManyConnectionsPerIP = errors.New("too many WebSocket connections from the client address")
+)
+
+// SessionInfo describes a live WebSocket session.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Endpoint   string    `json:"endpoint"`
+	Target     string    `json:"target"`
+	RemoteAddr string    `json:"remoteAddr"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// session is a live WebSocket session tracked by Sessions.
+type session struct {
+	info      SessionInfo
+	conns     []*websocket.Conn
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// requestClose asks the session to close gracefully.
+func (s *session) requestClose() {
+	s.closeOnce.Do(func() { close(s.closing) })
+}
+
+// Sessions tracks the live WebSocket sessions of the gateway, so that they can be observed
+// and drained on shutdown. Sessions outlive configuration reloads.
+type Sessions struct {
+	mu         sync.Mutex
+	sessions   map[*session]struct{}
+	admissions map[string]*admission
+	wg         sync.WaitGroup
+	draining   bool
+}
+
+// admission counts the connections admitted to an endpoint, in total and per client address.
+type admission struct {
+	total int
+	perIP map[string]int
+}
+
+// NewSessions creates an empty set of sessions.
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions:   make(map[*session]struct{}),
+		admissions: make(map[string]*admission),
+	}
+}
+
+// Admit reserves a connection to the endpoint identified by key for a client address,
+// within the given maximum numbers of connections to the endpoint and per address.
+// Zero maximums are unlimited. The returned function releases the connection.
+func (s *Sessions) Admit(key, ip string, maxConnections, maxPerIP int) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.admissions[key]
+	if !ok {
+		a = &admission{perIP: make(map[string]int)}
+	}
+	if maxConnections > 0 && a.total >= maxConnections {
+		return nil, ErrTooManyConnections
+	}
+	if maxPerIP > 0 && a.perIP[ip] >= maxPerIP {
+		return nil, ErrTooManyConnectionsPerIP
+	}
+
+	s.admissions[key] = a
+	a.total++
+	a.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			a.total--
+			if a.perIP[ip]--; a.perIP[ip] == 0 {
+				delete(a.perIP, ip)
+			}
+			if a.total == 0 {
+				delete(s.admissions, key)
+			}
+		})
+	}, nil
+}
+
+// add registers a new session over the given connections. Sessions opened while draining
+// are asked to close right away.
+func (s *Sessions) add(info SessionInfo, conns ...*websocket.Conn) *session {
+	sess := &session{info: info, conns: conns, closing: make(chan struct{})}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[sess] = struct{}{}
+	s.wg.Add(1)
+	if s.draining {
+		sess.requestClose()
+	}
+	return sess
+}
+
+// remove unregisters a session once both of its connections are closed.
+func (s *Sessions) remove(sess *session) {
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+
+	s.wg.Done()
+}
+
+// Count returns the number of live sessions.
+func (s *Sessions) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+// List returns the live sessions, oldest first.
+func (s *Sessions) List() []SessionInfo {
+	s.mu.Lock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for sess := range s.sessions {
+		list = append(list, sess.info)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// Shutdown asks every live session to close with a "going away" close frame on both
+// legs, and waits for them to end. Sessions still open when the context is done are
+// closed abruptly, and the context's error is returned.
+func (s *Sessions) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	for sess := range s.sessions {
+		sess.requestClose()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for sess := range s.sessions {
+			for _, conn := range sess.conns {
+				_ = conn.Close()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
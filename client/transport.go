@@ -0,0 +1,165 @@
+package client
+
+import (
+	"crypto/tls"
+	"github.com/yarlson/GateH8/config"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport defaults, matching the ones of http.DefaultTransport except for the larger idle pool.
+const (
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// Transports hands out the HTTP clients used to reach the upstreams. Every upstream, made
+// of the targets of a backend or of a forward authentication service, gets its own client,
+// and therefore its own pool of keep-alive connections, shared by all the endpoints that
+// target it. The transports are built for a single configuration, and take over the
+// clients of the previous one whose upstream and settings did not change, so that their
+// pools survive reloads.
+type Transports struct {
+	mu       sync.Mutex
+	clients  map[transportKey]*http.Client
+	previous map[transportKey]*http.Client
+}
+
+// transportKey identifies the client of an upstream. Endpoints targeting the same upstream
+// with different settings cannot share a client.
+type transportKey struct {
+	upstream string
+	settings config.Transport
+}
+
+// NewTransports creates an empty set of transports, taking over the clients of the
+// previous ones if not nil.
+func NewTransports(previous *Transports) *Transports {
+	t := &Transports{clients: make(map[transportKey]*http.Client)}
+	if previous != nil {
+		previous.mu.Lock()
+		t.previous = previous.clients
+		previous.mu.Unlock()
+	}
+	return t
+}
+
+// Client returns the HTTP client for the upstream and its transport settings, creating it
+// if needed. A nil configuration selects the default settings.
+func (t *Transports) Client(upstream string, c *config.Transport) *http.Client {
+	key := transportKey{upstream: upstream}
+	if c != nil {
+		key.settings = *c
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if client, ok := t.clients[key]; ok {
+		return client
+	}
+
+	client, ok := t.previous[key]
+	if !ok {
+		client = &http.Client{
+			Transport: newTransport(key.settings),
+			// Redirects are relayed to the client as they are, like any other response.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	t.clients[key] = client
+	return client
+}
+
+// CloseUnused closes the idle connections of the clients that the current transports did
+// not take over. Their connections still serving requests are closed once idle for the
+// idle timeout of their transport, after which the clients are released.
+func (t *Transports) CloseUnused(current *Transports) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current.mu.Lock()
+	defer current.mu.Unlock()
+
+	for key, client := range t.clients {
+		if current.clients[key] != client {
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of all the transports.
+func (t *Transports) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, client := range t.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// Upstream returns the upstream of the backend, made of the scheme and host of its
+// targets, which identifies the client used to reach them.
+func Upstream(backend *config.Backend) string {
+	var origins []string
+	for _, target := range backend.GetTargets() {
+		origins = append(origins, Origin(target.URL))
+	}
+	slices.Sort(origins)
+	return strings.Join(slices.Compact(origins), ",")
+}
+
+// Origin returns the scheme and host of the URL. URLs are not parsed, as they may hold
+// placeholders, such as ${host}, or ${path} right after the host.
+func Origin(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	for _, end := range []string{"/", "?", "#", "${path}", "${query}"} {
+		rest, _, _ = strings.Cut(rest, end)
+	}
+	return scheme + "://" + rest
+}
+
+func newTransport(c config.Transport) *http.Transport {
+	keepAlive := c.KeepAlive.Or(defaultKeepAlive)
+	if c.KeepAlive < 0 {
+		keepAlive = -1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout.Or(defaultDialTimeout),
+		KeepAlive: keepAlive,
+	}
+
+	maxIdle := c.MaxIdleConnsPerHost
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdleConnsPerHost
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     !c.DisableHTTP2,
+		MaxIdleConnsPerHost:   maxIdle,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout.Or(defaultIdleConnTimeout),
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout.Or(defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(c.ResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Second,
+		DisableKeepAlives:     c.DisableKeepAlives,
+		DisableCompression:    true,
+	}
+	if c.DisableHTTP2 {
+		// A non-nil empty map disables HTTP/2 over TLS entirely.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
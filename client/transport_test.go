@@ -0,0 +1,78 @@
+package client
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTransportsClients(t *testing.T) {
+	transports := NewTransports(nil)
+
+	a := transports.Client("http://users:8080", &config.Transport{MaxConnsPerHost: 10})
+	b := transports.Client("http://users:8080", &config.Transport{MaxConnsPerHost: 10})
+	c := transports.Client("http://users:8080", &config.Transport{MaxConnsPerHost: 20, DisableHTTP2: true})
+	d := transports.Client("http://orders:8080", &config.Transport{MaxConnsPerHost: 10})
+
+	if a != b {
+		t.Errorf("Client() returned different clients for the same upstream and settings")
+	}
+	if a == c {
+		t.Errorf("Client() returned the same client for different settings")
+	}
+	if a == d {
+		t.Errorf("Client() returned the same client for different upstreams")
+	}
+	if transports.Client("http://users:8080", nil) != transports.Client("http://users:8080", &config.Transport{}) {
+		t.Errorf("Client(nil) differs from the client of the default settings")
+	}
+
+	transport := c.Transport.(*http.Transport)
+	if transport.MaxConnsPerHost != 20 || transport.TLSNextProto == nil || transport.ForceAttemptHTTP2 {
+		t.Errorf("transport = %+v, want 20 connections per host without HTTP/2", transport)
+	}
+	if transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("IdleConnTimeout = %s, want the default", transport.IdleConnTimeout)
+	}
+}
+
+func TestTransportsReload(t *testing.T) {
+	previous := NewTransports(nil)
+	kept := previous.Client("http://users:8080", nil)
+	changed := previous.Client("http://orders:8080", nil)
+	previous.Client("http://removed:8080", nil)
+
+	current := NewTransports(previous)
+	if current.Client("http://users:8080", nil) != kept {
+		t.Errorf("Client() did not take over the client of an unchanged upstream")
+	}
+	if current.Client("http://orders:8080", &config.Transport{MaxConnsPerHost: 10}) == changed {
+		t.Errorf("Client() took over the client of an upstream whose settings changed")
+	}
+	if len(current.clients) != 2 {
+		t.Errorf("clients = %d, want 2: the ones no longer used must not be kept", len(current.clients))
+	}
+	previous.CloseUnused(current)
+}
+
+func TestUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend config.Backend
+		want    string
+	}{
+		{name: "url", backend: config.Backend{URL: "http://users:8080/users/${id}?page=1"}, want: "http://users:8080"},
+		{name: "host placeholder", backend: config.Backend{URL: "https://${host}${path}"}, want: "https://${host}"},
+		{name: "targets", backend: config.Backend{Targets: []config.Target{
+			{URL: "http://b:8080/api"}, {URL: "http://a:8080"}, {URL: "http://b:8080/v2"},
+		}}, want: "http://a:8080,http://b:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Upstream(&tt.backend); got != tt.want {
+				t.Errorf("Upstream() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
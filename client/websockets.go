@@ -1,66 +1,258 @@
 package client
 
 import (
+	"errors"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 	"github.com/yarlson/GateH8/config"
 	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/metrics"
+	"github.com/yarlson/GateH8/upstream"
+	"net"
+	"net/http"
+	"time"
 )
 
+// keepalivePayload is the payload of the pings sent by the gateway itself. The pongs
+// answering them are consumed by the gateway instead of being relayed.
+const keepalivePayload = "gateh8-keepalive"
+
+// controlWriteWait bounds the time spent writing a control frame.
+const controlWriteWait = 5 * time.Second
+
+// closeGracePeriod is how long the second leg of a session is given to complete the close
+// handshake once the first one has closed, before both connections are closed abruptly.
+const closeGracePeriod = 5 * time.Second
+
 // WebSocketProxyClient is a client that handles the proxying of messages between a client
 // and a backend WebSocket service. It manages the initial connection with the backend
 // and the bidirectional message relay.
 type WebSocketProxyClient struct {
-	endpoint   config.Endpoint
-	clientConn *websocket.Conn
+	name                 string
+	endpoint             config.Endpoint
+	target               *upstream.Target
+	clientConn           *websocket.Conn
+	backendConn          *websocket.Conn
+	sessions             *Sessions
+	pingInterval         time.Duration
+	pongTimeout          time.Duration
+	compressionThreshold int
+	log                  *logrus.Entry
 }
 
 // NewWebSocketProxyClient initializes a new WebSocket proxy client. The client takes care of
-// establishing a connection with the backend and relaying messages to and from the client.
-func NewWebSocketProxyClient(endpoint config.Endpoint, clientConn *websocket.Conn) *WebSocketProxyClient {
+// relaying messages between the client and the selected backend target, over connections
+// already established with both. The session is tracked in sessions for as long as it lives,
+// and its metrics are recorded under the name of the endpoint.
+func NewWebSocketProxyClient(name string, endpoint config.Endpoint, target *upstream.Target, clientConn, backendConn *websocket.Conn, sessions *Sessions) *WebSocketProxyClient {
+	pingInterval := time.Duration(endpoint.WebSocket.PingInterval)
+	compressionThreshold := 0
+	if endpoint.WebSocket.Compression != nil {
+		compressionThreshold = endpoint.WebSocket.Compression.Threshold
+	}
 	return &WebSocketProxyClient{
-		endpoint:   endpoint,
-		clientConn: clientConn,
+		name:                 name,
+		endpoint:             endpoint,
+		target:               target,
+		clientConn:           clientConn,
+		backendConn:          backendConn,
+		sessions:             sessions,
+		pingInterval:         pingInterval,
+		pongTimeout:          endpoint.WebSocket.PongTimeout.Or(pingInterval),
+		compressionThreshold: compressionThreshold,
 	}
 }
 
-// HandleProxy establishes a connection with the backend WebSocket service and initiates
-// the bidirectional message relay. It manages two communication channels: one from
-// the client to the backend and another from the backend to the client.
-func (c *WebSocketProxyClient) HandleProxy() {
-	backendConn, _, err := websocket.DefaultDialer.Dial(c.endpoint.Backend.URL, nil)
-	if err != nil {
-		logger.L.Error("Failed to establish a WebSocket connection with the backend:", err)
-		return
-	}
+// HandleProxy initiates the bidirectional message relay between the client and the
+// backend WebSocket service. It manages two communication channels: one from
+// the client to the backend and another from the backend to the client. It returns once
+// both connections are closed: when one direction ends, the other one is given a short
+// grace period to complete the close handshake before being torn down.
+func (c *WebSocketProxyClient) HandleProxy(r *http.Request) {
+	backendConn := c.backendConn
 	defer backendConn.Close()
+	defer c.clientConn.Close()
 
-	// Set up two communication channels for bidirectional message relay.
+	// The session's log lines carry the request ID, the vhost and the endpoint of its handshake.
+	c.log = logger.FromContext(r.Context()).WithField("target", c.target.URL)
+
+	sess := c.sessions.add(SessionInfo{
+		ID:         middleware.GetReqID(r.Context()),
+		Endpoint:   c.name,
+		Target:     c.target.URL,
+		RemoteAddr: r.RemoteAddr,
+		StartedAt:  time.Now(),
+	}, c.clientConn, backendConn)
+	defer c.sessions.remove(sess)
+
+	// Closed once the session ends, to stop the keepalive pings.
 	done := make(chan struct{})
 	defer close(done)
 
-	// One channel listens to messages from the client and sends them to the backend.
-	go c.relayMessages(c.clientConn, backendConn)
+	// Control frames are relayed as they are read, alongside the data messages.
+	c.relayControl(c.clientConn, backendConn)
+	c.relayControl(backendConn, c.clientConn)
+
+	// Keep both legs alive and detect dead peers, if configured.
+	go c.keepalive(c.clientConn, done)
+	go c.keepalive(backendConn, done)
+
+	// Each direction reports on finished when it stops relaying.
+	finished := make(chan struct{}, 2)
+
+	// One channel listens to messages from the client and sends them to the backend,
+	// within the limits of the endpoint.
+	go func() {
+		c.relayMessages(c.clientConn, backendConn, metrics.Upstream, newMessageLimiter(c.endpoint.WebSocket.Limits))
+		finished <- struct{}{}
+	}()
 
 	// The other listens to messages from the backend and sends them to the client.
-	go c.relayMessages(backendConn, c.clientConn)
+	go func() {
+		c.relayMessages(backendConn, c.clientConn, metrics.Downstream, nil)
+		finished <- struct{}{}
+	}()
 
-	// Wait until both communication channels complete their operations.
-	<-done
+	// Wait until either side closes, or until the session is drained on shutdown.
+	remaining := 2
+	select {
+	case <-finished:
+		remaining--
+	case <-sess.closing:
+		goingAway := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		_ = writeControl(c.clientConn, websocket.CloseMessage, goingAway)
+		_ = writeControl(backendConn, websocket.CloseMessage, goingAway)
+	}
+
+	// Give the other side a chance to complete the close handshake, then tear both connections down.
+	grace := time.NewTimer(closeGracePeriod)
+	defer grace.Stop()
+	for remaining > 0 {
+		select {
+		case <-finished:
+			remaining--
+		case <-grace.C:
+			_ = c.clientConn.Close()
+			_ = backendConn.Close()
+		}
+	}
 }
 
 // relayMessages handles the relay of messages between a source and a destination WebSocket.
-// It continuously listens for incoming messages from the source and forwards them to the destination.
-func (c *WebSocketProxyClient) relayMessages(src, dst *websocket.Conn) {
+// It continuously listens for incoming messages from the source and forwards them to the
+// destination with their original type. Once the source closes, its close code and reason
+// are forwarded to the destination. A source exceeding the limits is disconnected, and the
+// destination is told why. The relayed messages are counted in the given direction.
+func (c *WebSocketProxyClient) relayMessages(src, dst *websocket.Conn, direction string, limiter *messageLimiter) {
+	messages, bytes := metrics.WebSocketCounters(c.name, direction)
+	// The peer must show signs of life within the first keepalive period as well.
+	c.extendReadDeadline(src)
 	for {
-		_, message, err := src.ReadMessage()
+		messageType, message, err := limiter.readMessage(src)
+		if limitErr, ok := isLimitError(err); ok {
+			c.log.Warnf("Closing WebSocket session: %s", limitErr.reason)
+			closeMessage := websocket.FormatCloseMessage(limitErr.code, limitErr.reason)
+			_ = writeControl(src, websocket.CloseMessage, closeMessage)
+			_ = writeControl(dst, websocket.CloseMessage, closeMessage)
+			break
+		}
 		if err != nil {
-			logger.L.Error("Error occurred while reading a message for relay:", err)
+			c.relayClose(dst, err)
 			break
 		}
-		err = dst.WriteMessage(websocket.TextMessage, message)
+		c.extendReadDeadline(src)
+
+		// Small messages are not worth compressing, on legs using permessage-deflate.
+		dst.EnableWriteCompression(len(message) >= c.compressionThreshold)
+		err = dst.WriteMessage(messageType, message)
 		if err != nil {
-			logger.L.Error("Error occurred while sending a relayed message:", err)
+			c.log.WithError(err).Error("Error occurred while sending a relayed message")
 			break
 		}
+		messages.Inc()
+		bytes.Add(float64(len(message)))
+	}
+}
+
+// relayControl installs the control frame handlers of the source connection: pings and
+// pongs are forwarded to the destination, and close frames are left to relayMessages so
+// that the close handshake happens end-to-end.
+func (c *WebSocketProxyClient) relayControl(src, dst *websocket.Conn) {
+	src.SetPingHandler(func(data string) error {
+		c.extendReadDeadline(src)
+		return writeControl(dst, websocket.PingMessage, []byte(data))
+	})
+	src.SetPongHandler(func(data string) error {
+		c.extendReadDeadline(src)
+		if data == keepalivePayload {
+			return nil
+		}
+		return writeControl(dst, websocket.PongMessage, []byte(data))
+	})
+	src.SetCloseHandler(func(int, string) error {
+		return nil
+	})
+}
+
+// keepalive pings the connection at the configured interval until the done channel is
+// closed or the connection fails.
+func (c *WebSocketProxyClient) keepalive(conn *websocket.Conn, done <-chan struct{}) {
+	if c.pingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, []byte(keepalivePayload), time.Now().Add(controlWriteWait))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// extendReadDeadline pushes back the deadline by which the peer must show signs of life.
+// It must only be called from the goroutine reading the connection.
+func (c *WebSocketProxyClient) extendReadDeadline(conn *websocket.Conn) {
+	if c.pingInterval > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(c.pingInterval + c.pongTimeout))
+	}
+}
+
+// relayClose forwards the closure of a connection, described by the error its reader
+// returned, to the other connection of the session.
+func (c *WebSocketProxyClient) relayClose(dst *websocket.Conn, err error) {
+	code, text := websocket.CloseGoingAway, ""
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+			// Reserved codes that cannot be sent on the wire.
+		default:
+			code, text = closeErr.Code, closeErr.Text
+		}
+	} else {
+		c.log.WithError(err).Error("Error occurred while reading a message for relay")
+	}
+
+	_ = writeControl(dst, websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+}
+
+// writeControl writes a control frame, ignoring the errors caused by a connection that is
+// already closing, like the default handlers of the websocket package do.
+func writeControl(conn *websocket.Conn, messageType int, data []byte) error {
+	err := conn.WriteControl(messageType, data, time.Now().Add(controlWriteWait))
+	var netErr net.Error
+	if errors.Is(err, websocket.ErrCloseSent) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil
 	}
+	return err
 }
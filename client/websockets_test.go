@@ -0,0 +1,300 @@
+package client
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/upstream"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRelay starts a WebSocket backend running handle, and a proxy relaying to it with
+// the settings, if any. The returned channel is closed once the proxy handler has returned.
+func newTestRelay(t *testing.T, sessions *Sessions, ws *config.WebSocketConfig, handle func(conn *websocket.Conn)) (string, <-chan struct{}) {
+	upgrader := websocket.Upgrader{}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}))
+	t.Cleanup(backend.Close)
+
+	backendURL := "ws" + strings.TrimPrefix(backend.URL, "http")
+	pool := upstream.NewPool("test", &config.Backend{URL: backendURL})
+	if ws == nil {
+		ws = &config.WebSocketConfig{}
+	}
+	endpoint := config.Endpoint{Path: "/ws", WebSocket: ws}
+
+	returned := make(chan struct{})
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, nil)
+		if err != nil {
+			t.Errorf("Dial() error = %v", err)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		NewWebSocketProxyClient("test", endpoint, pool.Targets()[0], conn, backendConn, sessions).HandleProxy(r)
+		close(returned)
+	}))
+	t.Cleanup(gateway.Close)
+
+	return "ws" + strings.TrimPrefix(gateway.URL, "http") + "/ws", returned
+}
+
+func TestWebSocketRelay(t *testing.T) {
+	sessions := NewSessions()
+	closeCode := make(chan int, 1)
+
+	url, returned := newTestRelay(t, sessions, nil, func(conn *websocket.Conn) {
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if ce, ok := err.(*websocket.CloseError); ok {
+					closeCode <- ce.Code
+					_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ce.Code, ""))
+				}
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0, 1, 2}); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if messageType != websocket.BinaryMessage || string(message) != "\x00\x01\x02" {
+		t.Errorf("ReadMessage() = %d %q, want binary message", messageType, message)
+	}
+	if sessions.Count() != 1 {
+		t.Errorf("Count() = %d, want 1", sessions.Count())
+	}
+
+	if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "bye")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	select {
+	case code := <-closeCode:
+		if code != 4001 {
+			t.Errorf("backend close code = %d, want 4001", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend did not receive the close frame")
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleProxy() did not return after the session closed")
+	}
+	if sessions.Count() != 0 {
+		t.Errorf("Count() = %d, want 0", sessions.Count())
+	}
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	ws := &config.WebSocketConfig{PingInterval: config.Duration(50 * time.Millisecond), PongTimeout: config.Duration(50 * time.Millisecond)}
+	pings := make(chan string, 100)
+
+	url, _ := newTestRelay(t, NewSessions(), ws, func(conn *websocket.Conn) {
+		conn.SetPingHandler(func(data string) error {
+			received(pings, data)
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	// A client answering the pings stays connected, however long it remains silent.
+	pongs := make(chan string, 100)
+	conn.SetPongHandler(func(data string) error {
+		received(pongs, data)
+		return nil
+	})
+	messages := make(chan string, 1)
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(message)
+		}
+	}()
+	if err := conn.WriteControl(websocket.PingMessage, []byte("hello"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteControl() error = %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("still there")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	select {
+	case message := <-messages:
+		if message != "still there" {
+			t.Errorf("message = %q, want %q", message, "still there")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the session did not survive the keepalive pings")
+	}
+
+	// The pings of the client reach the backend, and only the pongs answering them come
+	// back: the ones answering the gateway's own pings are not relayed.
+	if gotPongs := drain(pongs); len(gotPongs) != 1 || gotPongs[0] != "hello" {
+		t.Errorf("client pongs = %q, want only hello", gotPongs)
+	}
+	gotPings := drain(pings)
+	if len(gotPings) < 2 || gotPings[0] != "hello" {
+		t.Errorf("backend pings = %q, want hello then keepalive pings", gotPings)
+	}
+	for _, data := range gotPings[1:] {
+		if data != keepalivePayload {
+			t.Errorf("backend ping = %q, want %q", data, keepalivePayload)
+		}
+	}
+}
+
+// received records the payload of a control frame, unless too many were already received.
+func received(payloads chan<- string, data string) {
+	select {
+	case payloads <- data:
+	default:
+	}
+}
+
+// drain returns the payloads received so far.
+func drain(payloads <-chan string) []string {
+	var got []string
+	for {
+		select {
+		case data := <-payloads:
+			got = append(got, data)
+		default:
+			return got
+		}
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	ws := &config.WebSocketConfig{PingInterval: config.Duration(50 * time.Millisecond), PongTimeout: config.Duration(50 * time.Millisecond)}
+	backendCode := make(chan int, 1)
+
+	url, returned := newTestRelay(t, NewSessions(), ws, func(conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if ce, ok := err.(*websocket.CloseError); ok {
+					backendCode <- ce.Code
+				}
+				return
+			}
+		}
+	})
+
+	// The client never reads, and so never answers the pings.
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case code := <-backendCode:
+		if code != websocket.CloseGoingAway {
+			t.Errorf("backend close code = %d, want %d", code, websocket.CloseGoingAway)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the unresponsive client was not disconnected")
+	}
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleProxy() did not return after the idle timeout")
+	}
+}
+
+func TestSessionsShutdown(t *testing.T) {
+	sessions := NewSessions()
+	backendCode := make(chan int, 1)
+
+	url, returned := newTestRelay(t, sessions, nil, func(conn *websocket.Conn) {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if ce, ok := err.(*websocket.CloseError); ok {
+					backendCode <- ce.Code
+				}
+				return
+			}
+		}
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the session to be registered.
+	for i := 0; sessions.Count() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- sessions.Shutdown(ctx)
+	}()
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("client ReadMessage() error = %v, want going away", err)
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+
+	if code := <-backendCode; code != websocket.CloseGoingAway {
+		t.Errorf("backend close code = %d, want %d", code, websocket.CloseGoingAway)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	<-returned
+	if sessions.Count() != 0 {
+		t.Errorf("Count() = %d, want 0", sessions.Count())
+	}
+}
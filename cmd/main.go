@@ -5,16 +5,26 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/yarlson/GateH8/admin"
 	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/gateway"
 	"github.com/yarlson/GateH8/logger"
-	"github.com/yarlson/GateH8/router"
+	"github.com/yarlson/GateH8/tracing"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"syscall"
 	"time"
 )
 
+const (
+	// configEnvVar is the environment variable holding the path of the configuration file.
+	configEnvVar = "GATEH8_CONFIG"
+	// configWatchInterval is how often the configuration files are checked for changes.
+	configWatchInterval = 2 * time.Second
+)
+
 func main() {
 	// Get the logger.
 	log := logger.GetLogger()
@@ -24,28 +34,104 @@ func main() {
 	flag.StringVar(&serverAddr, "addr", ":1973", "Server address and port")
 	flag.StringVar(&serverAddr, "a", ":1973", "Server address and port (shorthand)")
 
+	// Define the command-line argument for the configuration file, defaulting to the GATEH8_CONFIG environment variable.
+	configPath := os.Getenv(configEnvVar)
+	if configPath == "" {
+		configPath = config.DefaultPath
+	}
+	flag.StringVar(&configPath, "config", configPath, "Configuration file")
+	flag.StringVar(&configPath, "c", configPath, "Configuration file (shorthand)")
+
+	// Define the command-line arguments overriding the log settings of the configuration.
+	var logFlags config.Log
+	flag.StringVar(&logFlags.Level, "log-level", "", "Log level")
+	flag.StringVar(&logFlags.Format, "log-format", "", "Log format")
+
 	// Customize the default flag.Usage function
 	flag.Usage = Usage()
 
 	flag.Parse()
 
 	// Fetch the API Gateway's configuration using the utility function from the internal package.
-	cfg, err := config.GetConfig()
+	cfg, err := config.GetConfig(configPath)
 	if err != nil {
 		// Log and exit if there's an error loading the configuration.
 		log.Fatal("Error loading configuration:", err)
 	}
 
-	// Initialize the router with the provided configuration. This router handles
-	// requests based on the vhost, endpoint, and backend service configurations.
-	r := router.NewRouter(cfg)
+	// Apply the log settings, the command-line ones taking precedence over the configuration.
+	applyLogFlags(cfg, logFlags)
+	if err := logger.Configure(cfg.Log); err != nil {
+		log.Fatal("Error configuring the logger:", err)
+	}
+
+	// Set up the tracing of the requests, if configured. It is not affected by reloads.
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		log.Fatal("Error initializing tracing:", err)
+	}
+
+	// Initialize the gateway with the provided configuration. It routes requests based on
+	// the vhost, endpoint, and backend service configurations, and can be reloaded at runtime.
+	gw, err := gateway.New(cfg)
+	if err != nil {
+		log.Fatal("Error initializing gateway:", err)
+	}
+	defer gw.Close()
+
+	// Start the admin listener, if configured, to expose the gateway's internal state and control it.
+	var adminSrv *http.Server
+	if cfg.Admin != nil {
+		listener, err := admin.Listen(cfg.Admin)
+		if err != nil {
+			log.Fatal("Error starting admin server:", err)
+		}
+		if cfg.Admin.Token == "" && cfg.Admin.Socket == "" && !isLoopback(cfg.Admin.Addr) {
+			log.Warnf("Admin listener at %s is not protected by a token", cfg.Admin.Addr)
+		}
+		adminSrv = &http.Server{
+			Handler: admin.NewRouter(gw, cfg.Admin, func() error { return reload(gw, configPath, logFlags) }),
+		}
+		go func() {
+			log.Infof("Admin listener is ready at %s", listener.Addr())
+			if err := adminSrv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Error starting admin server:", err)
+			}
+		}()
+	}
 
 	// Create a new server and configure it.
 	srv := &http.Server{
 		Addr:    serverAddr,
-		Handler: r,
+		Handler: gw,
+	}
+
+	// Reload the configuration on SIGHUP and whenever the configuration file changes.
+	ctx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+
+	reloads := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloads <- struct{}{}:
+		default: // A reload is already pending.
+		}
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			requestReload()
+		}
+	}()
+	go config.Watch(ctx, configWatchInterval, func() []string { return gw.Config().Files }, requestReload)
+	go func() {
+		for range reloads {
+			_ = reload(gw, configPath, logFlags)
+		}
+	}()
+
 	// Use a channel to listen for interrupt signals to gracefully shutdown.
 	done := make(chan struct{}, 1)
 	quit := make(chan os.Signal, 1)
@@ -63,6 +149,16 @@ func main() {
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Fatalf("Could not gracefully shutdown the server: %v\n", err)
 		}
+		// WebSocket connections are hijacked, and so left alone by the server's shutdown.
+		if err := gw.Sessions().Shutdown(ctx); err != nil {
+			log.Warn("WebSocket sessions did not close in time: ", err)
+		}
+		if adminSrv != nil {
+			_ = adminSrv.Shutdown(ctx)
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warn("Error flushing traces: ", err)
+		}
 		close(done)
 	}()
 
@@ -70,27 +166,11 @@ func main() {
 	log.Infof("Server is ready to handle requests at %s", serverAddr)
 
 	if cfg.UseTLS {
+		// Certificates are looked up in the current configuration, so that reloads refresh them too.
+		// So are the settings of the vhosts authenticating their clients by certificate.
 		srv.TLSConfig = &tls.Config{
-			GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				for vhostName, vhost := range cfg.Vhosts {
-					if vhost.TLS != nil {
-						// Using wildcard pattern matching to determine the appropriate certificate.
-						match, err := filepath.Match(vhostName, info.ServerName)
-						if err != nil {
-							return nil, err
-						}
-
-						if match {
-							cert, err := tls.LoadX509KeyPair(vhost.TLS.Cert, vhost.TLS.Key)
-							if err != nil {
-								return nil, err
-							}
-							return &cert, nil
-						}
-					}
-				}
-				return nil, fmt.Errorf("no certificate for given hostname: %s", info.ServerName)
-			},
+			GetCertificate:     gw.GetCertificate,
+			GetConfigForClient: gw.GetConfigForClient,
 		}
 
 		if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
@@ -106,11 +186,67 @@ func main() {
 	log.Info("Server stopped")
 }
 
+// reload re-reads the configuration and applies it to the gateway. The current
+// configuration stays in use when the new one is invalid, and the error is returned.
+func reload(gw *gateway.Gateway, configPath string, logFlags config.Log) error {
+	log := logger.GetLogger()
+	log.Info("Reloading configuration...")
+
+	cfg, err := config.GetConfig(configPath)
+	if err != nil {
+		log.Error("Error reloading configuration, keeping the current one: ", err)
+		return err
+	}
+	// The log settings are only applied along with the rest of the configuration.
+	applyLogFlags(cfg, logFlags)
+	if err := gw.Reload(cfg); err != nil {
+		log.Error("Error applying configuration, keeping the current one: ", err)
+		return err
+	}
+	if err := logger.Configure(cfg.Log); err != nil {
+		log.Error("Error configuring the logger: ", err)
+	}
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// isLoopback reports whether the address only listens on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// applyLogFlags overrides the log settings of the configuration with the ones given on
+// the command line, so that the vhosts inherit them too.
+func applyLogFlags(cfg *config.Config, logFlags config.Log) {
+	settings := config.Log{}
+	if cfg.Log != nil {
+		settings = *cfg.Log
+	}
+	if logFlags.Level != "" {
+		settings.Level = logFlags.Level
+	}
+	if logFlags.Format != "" {
+		settings.Format = logFlags.Format
+	}
+	cfg.Log = &settings
+}
+
 // Usage returns a function that prints the command-line usage message.
 func Usage() func() {
 	return func() {
 		fmt.Printf("Usage of %s:\n", os.Args[0])
-		fmt.Println("  -a, --addr string:   Server address and port (default \":1973\")")
-		fmt.Println("  -h:                 Show this help message")
+		fmt.Println("  -a, --addr string:    Server address and port (default \":1973\")")
+		fmt.Println("  -c, --config string:  Configuration file, JSON, YAML or TOML (default $GATEH8_CONFIG or \"config.json\")")
+		fmt.Println("  --log-level string:  Log level: trace, debug, info, warn, error, fatal or panic (default \"info\")")
+		fmt.Println("  --log-format string: Log format: json, text or logfmt (default \"json\")")
+		fmt.Println("  -h:                  Show this help message")
 	}
 }
@@ -1,9 +1,11 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -25,11 +27,46 @@ type CORSConfig struct {
 }
 
 // WebSocketConfig contains configurations specific to WebSocket proxying.
-// This includes the backend service URL, as well as the read and write buffer sizes.
+// This includes the read and write buffer sizes, the allowed origins and the keepalive
+// pings sent by the gateway on both legs of a session: when PingInterval is set, a peer
+// that sends nothing, not even a pong, for PingInterval plus PongTimeout is disconnected.
+// Limits optionally bounds the connections and messages of the clients, and Compression
+// enables permessage-deflate on either leg.
 type WebSocketConfig struct {
-	ReadBufferSize  int      `json:"readBufferSize"`
-	WriteBufferSize int      `json:"writeBufferSize"`
-	AllowedOrigins  []string `json:"allowedOrigins"`
+	ReadBufferSize  int                   `json:"readBufferSize"`
+	WriteBufferSize int                   `json:"writeBufferSize"`
+	AllowedOrigins  []string              `json:"allowedOrigins"`
+	PingInterval    Duration              `json:"pingInterval,omitempty"`
+	PongTimeout     Duration              `json:"pongTimeout,omitempty"`
+	ForwardHeaders  []string              `json:"forwardHeaders,omitempty"`
+	Limits          *WebSocketLimits      `json:"limits,omitempty"`
+	Compression     *WebSocketCompression `json:"compression,omitempty"`
+}
+
+// WebSocketCompression configures the permessage-deflate extension. It is negotiated
+// independently with the client and with the backend. Level is a compress/flate level,
+// from -2 (Huffman only) to 9 (best compression), defaulting to 1 (best speed) when nil.
+// Messages smaller than Threshold bytes are sent uncompressed.
+type WebSocketCompression struct {
+	Client    bool `json:"client"`
+	Backend   bool `json:"backend"`
+	Level     *int `json:"level,omitempty"`
+	Threshold int  `json:"threshold,omitempty"`
+}
+
+// WebSocketLimits bounds what clients can open and send through a WebSocket endpoint.
+// Zero values disable the corresponding limit. Message rates are measured per connection,
+// with bursts of up to one second worth of traffic. A client exceeding the message size or
+// rate limits is disconnected with the configured close code, and handshakes beyond the
+// connection limits are rejected.
+type WebSocketLimits struct {
+	MaxMessageSize         int64   `json:"maxMessageSize,omitempty"`
+	MessagesPerSecond      float64 `json:"messagesPerSecond,omitempty"`
+	BytesPerSecond         float64 `json:"bytesPerSecond,omitempty"`
+	MaxConnections         int     `json:"maxConnections,omitempty"`
+	MaxConnectionsPerIP    int     `json:"maxConnectionsPerIp,omitempty"`
+	MessageTooBigCloseCode int     `json:"messageTooBigCloseCode,omitempty"`
+	RateLimitCloseCode     int     `json:"rateLimitCloseCode,omitempty"`
 }
 
 // Endpoint represents a specific route or API endpoint, detailing its
@@ -40,20 +77,171 @@ type Endpoint struct {
 	Path      string           `json:"path"`
 	Methods   []string         `json:"methods"`
 	Backend   *Backend         `json:"backend"`
+	Retry     *RetryPolicy     `json:"retry,omitempty"`
 	WebSocket *WebSocketConfig `json:"websocket,omitempty"`
+	// JWT overrides the JWT validation of the vhost for the endpoint.
+	JWT *JWT `json:"jwt,omitempty"`
+	// APIKey overrides the API key authentication of the vhost for the endpoint.
+	APIKey *APIKeyAuth `json:"apiKey,omitempty"`
+	// BasicAuth overrides the Basic authentication of the vhost for the endpoint.
+	BasicAuth *BasicAuth `json:"basicAuth,omitempty"`
+	// ForwardAuth authorizes the requests of the endpoint with an external service.
+	ForwardAuth *ForwardAuth `json:"forwardAuth,omitempty"`
+	// ClientCert restricts the endpoint to the clients with a verified TLS certificate.
+	ClientCert *ClientCertPolicy `json:"clientCert,omitempty"`
+}
+
+// Transport error classes that can be listed in RetryPolicy.RetryOnErrors.
+const (
+	RetryOnConnect = "connect"
+	RetryOnTimeout = "timeout"
+	RetryOnAny     = "any"
+)
+
+// RetryPolicy configures how failed requests to an endpoint's backend are retried.
+// Only requests with one of the listed Methods (idempotent methods by default) whose
+// body fits in MaxBodySize are retried, with an exponential backoff with full jitter
+// between Backoff.Base and Backoff.Max.
+type RetryPolicy struct {
+	Attempts      int           `json:"attempts"`
+	RetryOn       []int         `json:"retryOn,omitempty"`
+	RetryOnErrors []string      `json:"retryOnErrors,omitempty"`
+	Methods       []string      `json:"methods,omitempty"`
+	Backoff       BackoffConfig `json:"backoff,omitempty"`
+	MaxBodySize   int64         `json:"maxBodySize,omitempty"`
+}
+
+// BackoffConfig bounds the delay between two attempts of a request.
+type BackoffConfig struct {
+	Base Duration `json:"base,omitempty"`
+	Max  Duration `json:"max,omitempty"`
+}
+
+// RetryBudget caps the share of retries across the whole gateway, so that a failing
+// backend does not turn into a retry storm. Retries are allowed as long as they stay
+// below Ratio of the requests seen in the last ten seconds, with a floor of
+// MinRetriesPerSecond.
+type RetryBudget struct {
+	Ratio               float64 `json:"ratio"`
+	MinRetriesPerSecond int     `json:"minRetriesPerSecond"`
 }
 
 // Backend defines the actual service to which the API Gateway will
-// route the requests. This includes the service URL and any associated
-// timeout settings.
+// route the requests. This includes the service URL (or a pool of weighted
+// targets), the load balancing strategy and any associated timeout settings.
 type Backend struct {
-	URL     string `json:"url"`
-	Timeout int    `json:"timeout"`
+	URL            string          `json:"url"`
+	AppendQuery    *bool           `json:"appendQuery,omitempty"`
+	Targets        []Target        `json:"targets,omitempty"`
+	Balancer       *BalancerConfig `json:"balancer,omitempty"`
+	HealthCheck    *HealthCheck    `json:"healthCheck,omitempty"`
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
+	Transport      *Transport      `json:"transport,omitempty"`
+	Timeout        int             `json:"timeout"`
+	// FlushInterval is how often streamed responses are flushed to the client. Responses are
+	// flushed after every write when it is negative, and only once complete when it is zero.
+	FlushInterval Duration `json:"flushInterval,omitempty"`
 }
 
-// GetProcessedURL returns the full URL by substituting any placeholders in the URL.
-func (b *Backend) GetProcessedURL(endpointPath string) string {
-	return strings.Replace(b.URL, "${path}", endpointPath, -1)
+// AppendsQuery reports whether the query string of the incoming request is appended to
+// backend URLs that do not reference it with ${query}. It defaults to true.
+func (b *Backend) AppendsQuery() bool {
+	return b.AppendQuery == nil || *b.AppendQuery
+}
+
+// GetTargets returns the list of upstream targets of the backend.
+// A backend configured with a single URL is treated as a pool of one target.
+func (b *Backend) GetTargets() []Target {
+	if len(b.Targets) > 0 {
+		return b.Targets
+	}
+	return []Target{{URL: b.URL, Weight: 1}}
+}
+
+// Target is a single upstream server within a backend pool.
+type Target struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Load balancing strategies supported by BalancerConfig.
+const (
+	RoundRobin       = "round-robin"
+	WeightedRandom   = "weighted-random"
+	LeastConnections = "least-connections"
+	ConsistentHash   = "consistent-hash"
+)
+
+// Sources of the consistent hashing key supported by BalancerConfig.
+const (
+	HashOnHeader = "header"
+	HashOnCookie = "cookie"
+	HashOnIP     = "ip"
+)
+
+// BalancerConfig selects the strategy used to spread requests across the targets of a backend.
+// HashOn and HashKey are only used by the consistent-hash strategy; HashKey names the header
+// or cookie to hash and is ignored when hashing on the client IP.
+type BalancerConfig struct {
+	Strategy string `json:"strategy"`
+	HashOn   string `json:"hashOn,omitempty"`
+	HashKey  string `json:"hashKey,omitempty"`
+}
+
+// Transport tunes the connections opened to the targets of a backend. Backends with the
+// same targets and transport settings share their connection pools.
+type Transport struct {
+	MaxIdleConnsPerHost   int      `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost       int      `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout       Duration `json:"idleConnTimeout,omitempty"`
+	DialTimeout           Duration `json:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout,omitempty"`
+	KeepAlive             Duration `json:"keepAlive,omitempty"`
+	DisableKeepAlives     bool     `json:"disableKeepAlives,omitempty"`
+	DisableHTTP2          bool     `json:"disableHTTP2,omitempty"`
+}
+
+// Health check modes supported by HealthCheck.
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+)
+
+// HealthCheck configures the active probing of the targets of a backend.
+// A target is marked unhealthy after Fall consecutive failed probes and healthy
+// again after Rise consecutive successful ones. In tcp mode a probe only opens a
+// connection to the target, which is the default for WebSocket backends.
+type HealthCheck struct {
+	Mode           string   `json:"mode,omitempty"`
+	Path           string   `json:"path,omitempty"`
+	ExpectedStatus int      `json:"expectedStatus,omitempty"`
+	Interval       Duration `json:"interval,omitempty"`
+	Timeout        Duration `json:"timeout,omitempty"`
+	Rise           int      `json:"rise,omitempty"`
+	Fall           int      `json:"fall,omitempty"`
+}
+
+// CircuitBreaker configures the passive outlier detection of the targets of a backend.
+// A target's circuit opens when it fails ConsecutiveFailures times in a row, or when the
+// ratio of failed requests within Window reaches ErrorRatio after at least MinRequests.
+// An open circuit rejects requests for CoolDown, then lets HalfOpenRequests probe
+// requests through to decide whether to close again.
+type CircuitBreaker struct {
+	ErrorRatio          float64           `json:"errorRatio,omitempty"`
+	MinRequests         int               `json:"minRequests,omitempty"`
+	ConsecutiveFailures int               `json:"consecutiveFailures,omitempty"`
+	Window              Duration          `json:"window,omitempty"`
+	CoolDown            Duration          `json:"coolDown,omitempty"`
+	HalfOpenRequests    int               `json:"halfOpenRequests,omitempty"`
+	Response            *FailFastResponse `json:"response,omitempty"`
+}
+
+// FailFastResponse is the response returned to the client when a request is rejected by the gateway itself.
+type FailFastResponse struct {
+	Status  int               `json:"status"`
+	Body    string            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // Vhost groups a set of endpoints and specifies any CORS and TLS configuration
@@ -62,36 +250,307 @@ type Vhost struct {
 	CORS      *CORSConfig `json:"cors,omitempty"`
 	Endpoints []Endpoint  `json:"endpoints"`
 	TLS       *TLSConfig  `json:"tls,omitempty"`
+	Log       *Log        `json:"log,omitempty"`
+	JWT       *JWT        `json:"jwt,omitempty"`
+	APIKey    *APIKeyAuth `json:"apiKey,omitempty"`
+	BasicAuth *BasicAuth  `json:"basicAuth,omitempty"`
+	// MaintenanceResponse is returned while the vhost is in maintenance mode, which is
+	// toggled through the admin listener. Defaults to a 503 Service Unavailable.
+	MaintenanceResponse *FailFastResponse `json:"maintenanceResponse,omitempty"`
+}
+
+// Supported JWT signing algorithms.
+var (
+	JWTHMACAlgorithms       = []string{"HS256", "HS384", "HS512"}
+	JWTAsymmetricAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+)
+
+// JWT configures the validation of the JSON Web Tokens presented by the clients. Tokens are
+// signed either with the secret (HS*) or with the public keys read from PEM files or
+// fetched from a JWKS URL (RS*, PS*, ES*, EdDSA).
+type JWT struct {
+	// Disabled turns off the JWT validation, letting an endpoint opt out of the one of its vhost.
+	Disabled bool     `json:"disabled,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+	KeyFiles []string `json:"keyFiles,omitempty"`
+	JWKSURL  string   `json:"jwksUrl,omitempty"`
+	// JWKSRefresh is how long the keys fetched from the JWKS URL are cached. Defaults to 1h.
+	JWKSRefresh Duration `json:"jwksRefresh,omitempty"`
+	// Algorithms restricts the accepted signing algorithms. Defaults to the ones of the configured keys.
+	Algorithms []string `json:"algorithms,omitempty"`
+	Issuer     string   `json:"issuer,omitempty"`
+	// Audience lists the accepted audiences, one of which the token must be issued for.
+	Audience []string `json:"audience,omitempty"`
+	Leeway   Duration `json:"leeway,omitempty"`
+	// RequiredClaims maps the claims the token must carry to their expected value, or to an
+	// empty string when any value is accepted.
+	RequiredClaims map[string]string `json:"requiredClaims,omitempty"`
+	// Scopes lists the scopes the token must all be granted, in its scope or scp claim.
+	Scopes []string `json:"scopes,omitempty"`
+	// ForwardClaims maps claims to the headers they are forwarded to the backend in.
+	ForwardClaims map[string]string `json:"forwardClaims,omitempty"`
+	// The token is read from the header (default Authorization, as a bearer token), the
+	// query parameter or the cookie, whichever is present first.
+	Header     string `json:"header,omitempty"`
+	QueryParam string `json:"queryParam,omitempty"`
+	Cookie     string `json:"cookie,omitempty"`
+}
+
+// Consumer is an API consumer, identified by its API keys.
+type Consumer struct {
+	Name string `json:"name"`
+	// Keys are the SHA-256 hashes of the consumer's API keys, hex encoded.
+	Keys []string `json:"keys"`
+	// Vhosts and Endpoints restrict the consumer to the matching vhosts, and to the matching
+	// endpoints named after their vhost and path, such as api.example.com/users/{id}.
+	// Wildcards are supported. The consumer is allowed everywhere if both are empty.
+	Vhosts    []string          `json:"vhosts,omitempty"`
+	Endpoints []string          `json:"endpoints,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// APIKeyAuth configures the authentication of the consumers by their API key, read from
+// the header (default X-API-Key) or the query parameter. The key is removed from the
+// request before it is proxied.
+type APIKeyAuth struct {
+	Header     string `json:"header,omitempty"`
+	QueryParam string `json:"queryParam,omitempty"`
+	// ForwardHeader is the header the name of the consumer is forwarded to the backend in.
+	ForwardHeader string `json:"forwardHeader,omitempty"`
+	// ForwardMetadataPrefix, when set, forwards every metadata entry of the consumer to the
+	// backend in a header named after its key with the prefix, such as X-Consumer-Team.
+	ForwardMetadataPrefix string `json:"forwardMetadataPrefix,omitempty"`
+}
+
+// BasicAuth configures HTTP Basic authentication with the users of an htpasswd file, whose
+// passwords are hashed with bcrypt, SHA-1 ({SHA}) or APR1-MD5 ($apr1$). The file is read
+// again when it changes.
+type BasicAuth struct {
+	HtpasswdFile string `json:"htpasswdFile"`
+	// Realm is announced to the clients in the authentication challenge. Defaults to "Restricted".
+	Realm string `json:"realm,omitempty"`
+	// ForwardHeader is the header the name of the authenticated user is forwarded to the backend in.
+	ForwardHeader string `json:"forwardHeader,omitempty"`
+}
+
+// Forward authentication cache key parts, in addition to the "header.<name>" and
+// "cookie.<name>" ones.
+const (
+	ForwardAuthKeyMethod = "method"
+	ForwardAuthKeyHost   = "host"
+	ForwardAuthKeyPath   = "path"
+	ForwardAuthKeyQuery  = "query"
+)
+
+// ForwardAuth configures the authorization of the requests by an external service. The
+// service receives a subrequest with the method, URI and headers of the original request:
+// a 2xx response lets the request through, with the ResponseHeaders of the response copied
+// into it, while any other response is returned to the client.
+type ForwardAuth struct {
+	URL string `json:"url"`
+	// RequestHeaders are the headers of the request sent to the service. All the end-to-end
+	// headers are sent by default.
+	RequestHeaders []string `json:"requestHeaders,omitempty"`
+	// ResponseHeaders are the headers of the service's response copied into the request.
+	ResponseHeaders []string `json:"responseHeaders,omitempty"`
+	// Timeout bounds the subrequest. Defaults to 5s.
+	Timeout Duration `json:"timeout,omitempty"`
+	// FailOpen lets the requests through when the service cannot be reached, instead of
+	// rejecting them with a 503 Service Unavailable.
+	FailOpen bool              `json:"failOpen,omitempty"`
+	Cache    *ForwardAuthCache `json:"cache,omitempty"`
+}
+
+// ForwardAuthCache configures the caching of the decisions of the forward authentication
+// service, for the requests with the same key. The key is made of the listed parts of the
+// request: method, host, path, query, header.<name> or cookie.<name>. Only the requests let
+// through and the ones rejected with a 401 or a 403 are cached.
+type ForwardAuthCache struct {
+	Key []string `json:"key"`
+	TTL Duration `json:"ttl"`
+	// MaxEntries bounds the number of cached decisions. Defaults to 10000.
+	MaxEntries int `json:"maxEntries,omitempty"`
 }
 
 // TLSConfig defines the TLS certificate and key files to be used by the API Gateway.
 type TLSConfig struct {
-	Cert string `json:"cert"`
-	Key  string `json:"key"`
+	Cert       string      `json:"cert"`
+	Key        string      `json:"key"`
+	ClientAuth *ClientAuth `json:"clientAuth,omitempty"`
+}
+
+// Client certificate modes of a vhost.
+const (
+	// ClientAuthNone does not request a certificate from the clients.
+	ClientAuthNone = "none"
+	// ClientAuthRequest requests a certificate, which is verified if presented and a CA
+	// bundle is configured.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire requires a certificate, without verifying it.
+	ClientAuthRequire = "require"
+	// ClientAuthVerify requires a certificate signed by one of the CAs of the bundle.
+	ClientAuthVerify = "verify"
+)
+
+// ClientAuth configures the authentication of the clients of a vhost by their TLS certificate.
+type ClientAuth struct {
+	Mode string `json:"mode"`
+	// CAFile is the PEM bundle of the CAs the client certificates are verified against.
+	CAFile string `json:"caFile,omitempty"`
+	// ForwardHeaders are the headers the details of the client certificate are forwarded
+	// to the backends in.
+	ForwardHeaders *ClientCertHeaders `json:"forwardHeaders,omitempty"`
+}
+
+// ClientCertHeaders names the headers the details of a client certificate are forwarded
+// in. Details whose header is empty are not forwarded.
+type ClientCertHeaders struct {
+	Subject string `json:"subject,omitempty"`
+	SANs    string `json:"sans,omitempty"`
+	// Fingerprint is the SHA-256 fingerprint of the certificate, hex encoded.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Cert is the URL-escaped PEM encoding of the certificate.
+	Cert string `json:"cert,omitempty"`
+}
+
+// ClientCertPolicy restricts an endpoint to the clients with a verified certificate whose
+// subject or one of its subject alternative names matches one of the patterns. Wildcards
+// are supported. Any verified certificate is allowed if both lists are empty.
+type ClientCertPolicy struct {
+	AllowedSubjects []string `json:"allowedSubjects,omitempty"`
+	AllowedSANs     []string `json:"allowedSans,omitempty"`
 }
 
 // Config provides a comprehensive view of the API Gateway's configuration,
 // encapsulating details about the gateway itself, as well as the vhosts
 // and their associated endpoints.
 type Config struct {
-	APIGateway APIGateway       `json:"apiGateway"`
-	Vhosts     map[string]Vhost `json:"vhosts"`
-	UseTLS     bool
+	APIGateway  APIGateway   `json:"apiGateway"`
+	Admin       *AdminConfig `json:"admin,omitempty"`
+	RetryBudget *RetryBudget `json:"retryBudget,omitempty"`
+	Tracing     *Tracing     `json:"tracing,omitempty"`
+	AccessLog   *AccessLog   `json:"accessLog,omitempty"`
+	Log         *Log         `json:"log,omitempty"`
+	Consumers   []Consumer   `json:"consumers,omitempty"`
+	// TrustedProxies lists the IPs and CIDR ranges whose forwarding headers are trusted.
+	TrustedProxies []string         `json:"trustedProxies,omitempty"`
+	Include        []string         `json:"include,omitempty"`
+	Vhosts         map[string]Vhost `json:"vhosts"`
+	UseTLS         bool
+
+	// Files lists the files and include directories the configuration was read from,
+	// along with the htpasswd files it references.
+	Files []string `json:"-"`
 }
 
-// GetConfig reads the API Gateway's configuration from a JSON file and returns it.
-// It handles any issues with reading or parsing the configuration file.
-func GetConfig() (*Config, error) {
-	rawConfig, err := os.ReadFile("config.json")
-	if err != nil {
-		return nil, fmt.Errorf("error reading config.json: %w", err)
-	}
+// AdminConfig configures the admin listener used to introspect and control the running
+// gateway. It listens either on a TCP address or on a Unix socket. When a token is set,
+// requests must present it as a bearer token.
+type AdminConfig struct {
+	Addr   string `json:"addr,omitempty"`
+	Socket string `json:"socket,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
 
-	rawConfig = replaceEnvVars(rawConfig)
+// Supported trace exporters.
+const (
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+)
+
+// Supported trace context propagation formats.
+const (
+	PropagatorTraceContext = "tracecontext"
+	PropagatorBaggage      = "baggage"
+	PropagatorB3           = "b3"
+	PropagatorB3Multi      = "b3multi"
+)
+
+// Tracing configures the OpenTelemetry traces of the gateway. Spans are exported to an
+// OTLP collector over gRPC or HTTP. SampleRatio is the share of new traces that are
+// sampled, 1 when left empty; traces started upstream follow the decision of their parent.
+// Propagators lists the formats of the trace context read from the requests and sent to
+// the backends, "tracecontext" (W3C) by default.
+type Tracing struct {
+	ServiceName string            `json:"serviceName,omitempty"`
+	Exporter    string            `json:"exporter"`
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Insecure    bool              `json:"insecure,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	SampleRatio *float64          `json:"sampleRatio,omitempty"`
+	Propagators []string          `json:"propagators,omitempty"`
+}
+
+// Supported log formats.
+const (
+	LogFormatJSON   = "json"
+	LogFormatText   = "text"
+	LogFormatLogfmt = "logfmt"
+)
 
+// logLevels are the supported log levels.
+var logLevels = []string{"panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"}
+
+// Log configures the level and the format of the gateway logs: "json" (default),
+// "text" or "logfmt". Vhosts can override them for the log lines of their requests.
+type Log struct {
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// Supported access log formats.
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogTemplate = "template"
+)
+
+// AccessLog configures the log of the requests served by the gateway. Format is one of
+// "json" (default), "common", "combined" or "template", in which case Template is a
+// text/template executed with the fields of the request. Fields selects the fields of the
+// JSON entries, and Headers the request headers added to them. Output is "stderr"
+// (default), "stdout" or the path of a file, optionally rotated. SampleRatio is the share
+// of the requests that are logged, 1 when left empty; server errors are always logged.
+type AccessLog struct {
+	Format      string        `json:"format,omitempty"`
+	Template    string        `json:"template,omitempty"`
+	Fields      []string      `json:"fields,omitempty"`
+	Headers     []string      `json:"headers,omitempty"`
+	Output      string        `json:"output,omitempty"`
+	Rotation    *LogRotation  `json:"rotation,omitempty"`
+	SampleRatio *float64      `json:"sampleRatio,omitempty"`
+	Redact      *LogRedaction `json:"redact,omitempty"`
+}
+
+// LogRotation configures the rotation of a log file, once it reaches MaxSize megabytes
+// or every Interval, whichever comes first. MaxBackups rotated files are kept, all of
+// them when left empty.
+type LogRotation struct {
+	MaxSize    int      `json:"maxSize,omitempty"`
+	Interval   Duration `json:"interval,omitempty"`
+	MaxBackups int      `json:"maxBackups,omitempty"`
+}
+
+// LogRedaction lists the request headers and query parameters whose values are masked
+// in the logs, in addition to the credentials headers that always are.
+type LogRedaction struct {
+	Headers     []string `json:"headers,omitempty"`
+	QueryParams []string `json:"queryParams,omitempty"`
+}
+
+// GetConfig reads the API Gateway's configuration from the file at the given path,
+// merges the files it includes and returns it. It handles any issues with reading,
+// parsing or validating the configuration.
+func GetConfig(path string) (*Config, error) {
 	config := new(Config) // Use new() to get a pointer directly, prevent local-to-heap migration.
-	if err = json.Unmarshal(rawConfig, config); err != nil {
-		return nil, fmt.Errorf("error parsing config.json: %w", err)
+	if err := readFile(path, config); err != nil {
+		return nil, err
+	}
+
+	config.Files = []string{path}
+	if err := loadIncludes(path, config); err != nil {
+		return nil, err
 	}
 
 	anyVhostWithSSL, allVhostsWithSSL := checkVhostsWithTLS(config)
@@ -101,19 +560,83 @@ func GetConfig() (*Config, error) {
 		return nil, fmt.Errorf("configuration error: either all vhosts should have TLS configured, or none should")
 	}
 
+	if err := validateBackends(config); err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseNetworks(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("configuration error: trustedProxies: %w", err)
+	}
+
+	if err := validateConsumers(config.Consumers); err != nil {
+		return nil, fmt.Errorf("configuration error: consumers: %w", err)
+	}
+
+	if err := validateAdmin(config.Admin); err != nil {
+		return nil, fmt.Errorf("configuration error: admin: %w", err)
+	}
+
+	if err := validateTracing(config.Tracing); err != nil {
+		return nil, fmt.Errorf("configuration error: tracing: %w", err)
+	}
+
+	if err := validateAccessLog(config.AccessLog); err != nil {
+		return nil, fmt.Errorf("configuration error: accessLog: %w", err)
+	}
+
+	if err := validateLog(config.Log); err != nil {
+		return nil, fmt.Errorf("configuration error: log: %w", err)
+	}
+	for vhostName, vhost := range config.Vhosts {
+		if err := validateLog(vhost.Log); err != nil {
+			return nil, fmt.Errorf("configuration error: vhost %s: log: %w", vhostName, err)
+		}
+		if err := validateJWT(vhost.JWT); err != nil {
+			return nil, fmt.Errorf("configuration error: vhost %s: jwt: %w", vhostName, err)
+		}
+		if vhost.BasicAuth != nil && vhost.BasicAuth.HtpasswdFile == "" {
+			return nil, fmt.Errorf("configuration error: vhost %s: basicAuth: htpasswdFile must be set", vhostName)
+		}
+		if err := validateClientAuth(vhost); err != nil {
+			return nil, fmt.Errorf("configuration error: vhost %s: %w", vhostName, err)
+		}
+	}
+
+	// The htpasswd files are watched along with the configuration, so that changes to the
+	// users are picked up by a reload.
+	for _, vhost := range config.Vhosts {
+		if vhost.BasicAuth != nil && !slices.Contains(config.Files, vhost.BasicAuth.HtpasswdFile) {
+			config.Files = append(config.Files, vhost.BasicAuth.HtpasswdFile)
+		}
+		for _, endpoint := range vhost.Endpoints {
+			if endpoint.BasicAuth != nil && !slices.Contains(config.Files, endpoint.BasicAuth.HtpasswdFile) {
+				config.Files = append(config.Files, endpoint.BasicAuth.HtpasswdFile)
+			}
+		}
+	}
+
 	config.UseTLS = anyVhostWithSSL
 	return config, nil
 }
 
 func replaceEnvVars(rawConfig []byte) []byte {
-	// replace ${path} with [[path]] to avoid env var replacement
-	rawConfig = []byte(strings.ReplaceAll(string(rawConfig), "${path}", "[[path]]"))
-	// replace env vars
-	rawConfig = []byte(os.ExpandEnv(string(rawConfig)))
-	// replace [[path]] with ${path} to restore original value
-	rawConfig = []byte(strings.ReplaceAll(string(rawConfig), "[[path]]", "${path}"))
+	// replace env vars, leaving the backend URL placeholders such as ${path} untouched
+	return []byte(os.Expand(string(rawConfig), func(name string) string {
+		if IsPlaceholder(name) {
+			return "${" + name + "}"
+		}
+		return os.Getenv(name)
+	}))
+}
 
-	return rawConfig
+// IsPlaceholder reports whether the name is one of the request placeholders of backend URL
+// templates: path, query, host, param.<name> and header.<name>.
+func IsPlaceholder(name string) bool {
+	switch name {
+	case "path", "query", "host":
+		return true
+	}
+	return strings.HasPrefix(name, "param.") || strings.HasPrefix(name, "header.")
 }
 
 func checkVhostsWithTLS(config *Config) (bool, bool) {
@@ -130,3 +653,351 @@ func checkVhostsWithTLS(config *Config) (bool, bool) {
 	}
 	return anyVhostWithSSL, allVhostsWithSSL
 }
+
+func validateBackends(config *Config) error {
+	for vhostName, vhost := range config.Vhosts {
+		for _, endpoint := range vhost.Endpoints {
+			if endpoint.Backend == nil {
+				return fmt.Errorf("configuration error: endpoint %s%s has no backend", vhostName, endpoint.Path)
+			}
+			if err := validateBackend(endpoint.Backend); err != nil {
+				return fmt.Errorf("configuration error: endpoint %s%s: %w", vhostName, endpoint.Path, err)
+			}
+			if err := validateRetry(endpoint.Retry); err != nil {
+				return fmt.Errorf("configuration error: endpoint %s%s: %w", vhostName, endpoint.Path, err)
+			}
+			if err := validateWebSocket(endpoint.WebSocket); err != nil {
+				return fmt.Errorf("configuration error: endpoint %s%s: %w", vhostName, endpoint.Path, err)
+			}
+			if err := validateJWT(endpoint.JWT); err != nil {
+				return fmt.Errorf("configuration error: endpoint %s%s: jwt: %w", vhostName, endpoint.Path, err)
+			}
+			if endpoint.BasicAuth != nil && endpoint.BasicAuth.HtpasswdFile == "" {
+				return fmt.Errorf("configuration error: endpoint %s%s: basicAuth: htpasswdFile must be set", vhostName, endpoint.Path)
+			}
+			if err := validateForwardAuth(endpoint.ForwardAuth); err != nil {
+				return fmt.Errorf("configuration error: endpoint %s%s: forwardAuth: %w", vhostName, endpoint.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateBackend(backend *Backend) error {
+	if backend.URL != "" && len(backend.Targets) > 0 {
+		return fmt.Errorf("backend must define either url or targets, not both")
+	}
+	for _, target := range backend.GetTargets() {
+		if target.URL == "" {
+			return fmt.Errorf("backend target url is empty")
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("backend target %s has a negative weight", target.URL)
+		}
+	}
+
+	if hc := backend.HealthCheck; hc != nil {
+		switch hc.Mode {
+		case "", HealthCheckHTTP, HealthCheckTCP:
+		default:
+			return fmt.Errorf("unknown health check mode %q", hc.Mode)
+		}
+		if hc.Rise < 0 || hc.Fall < 0 {
+			return fmt.Errorf("health check rise and fall must not be negative")
+		}
+	}
+
+	if cb := backend.CircuitBreaker; cb != nil {
+		if cb.ErrorRatio < 0 || cb.ErrorRatio > 1 {
+			return fmt.Errorf("circuit breaker errorRatio must be between 0 and 1")
+		}
+		if cb.ErrorRatio == 0 && cb.ConsecutiveFailures <= 0 {
+			return fmt.Errorf("circuit breaker needs an errorRatio or consecutiveFailures threshold")
+		}
+	}
+
+	if backend.Balancer == nil {
+		return nil
+	}
+	switch backend.Balancer.Strategy {
+	case "", RoundRobin, WeightedRandom, LeastConnections:
+	case ConsistentHash:
+		switch backend.Balancer.HashOn {
+		case HashOnIP:
+		case HashOnHeader, HashOnCookie:
+			if backend.Balancer.HashKey == "" {
+				return fmt.Errorf("balancer hashKey is required when hashing on a %s", backend.Balancer.HashOn)
+			}
+		default:
+			return fmt.Errorf("unknown balancer hashOn %q", backend.Balancer.HashOn)
+		}
+	default:
+		return fmt.Errorf("unknown balancer strategy %q", backend.Balancer.Strategy)
+	}
+	return nil
+}
+
+func validateRetry(retry *RetryPolicy) error {
+	if retry == nil {
+		return nil
+	}
+	if retry.Attempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1")
+	}
+	for _, class := range retry.RetryOnErrors {
+		switch class {
+		case RetryOnConnect, RetryOnTimeout, RetryOnAny:
+		default:
+			return fmt.Errorf("unknown retry error class %q", class)
+		}
+	}
+	return nil
+}
+
+func validateWebSocket(ws *WebSocketConfig) error {
+	if ws == nil {
+		return nil
+	}
+	if c := ws.Compression; c != nil {
+		if c.Level != nil && (*c.Level < -2 || *c.Level > 9) {
+			return fmt.Errorf("websocket compression level must be between -2 and 9")
+		}
+		if c.Threshold < 0 {
+			return fmt.Errorf("websocket compression threshold must not be negative")
+		}
+	}
+	if ws.Limits == nil {
+		return nil
+	}
+	limits := ws.Limits
+	if limits.MaxMessageSize < 0 || limits.MessagesPerSecond < 0 || limits.BytesPerSecond < 0 ||
+		limits.MaxConnections < 0 || limits.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("websocket limits must not be negative")
+	}
+	for _, code := range []int{limits.MessageTooBigCloseCode, limits.RateLimitCloseCode} {
+		if code == 0 {
+			continue
+		}
+		// 1005, 1006 and 1015 are reserved for reporting and cannot be sent in a close frame.
+		if code < 1000 || code > 4999 || code == 1005 || code == 1006 || code == 1015 {
+			return fmt.Errorf("invalid websocket close code %d", code)
+		}
+	}
+	return nil
+}
+
+func validateAdmin(admin *AdminConfig) error {
+	if admin == nil {
+		return nil
+	}
+	if (admin.Addr == "") == (admin.Socket == "") {
+		return fmt.Errorf("either addr or socket must be set")
+	}
+	return nil
+}
+
+func validateConsumers(consumers []Consumer) error {
+	names := make(map[string]bool, len(consumers))
+	keys := make(map[string]bool)
+	for _, consumer := range consumers {
+		if consumer.Name == "" {
+			return fmt.Errorf("consumer without a name")
+		}
+		if names[consumer.Name] {
+			return fmt.Errorf("duplicate consumer %s", consumer.Name)
+		}
+		names[consumer.Name] = true
+
+		if len(consumer.Keys) == 0 {
+			return fmt.Errorf("consumer %s has no keys", consumer.Name)
+		}
+		for _, key := range consumer.Keys {
+			if len(key) != 64 || strings.Trim(strings.ToLower(key), "0123456789abcdef") != "" {
+				return fmt.Errorf("consumer %s: keys must be hex encoded SHA-256 hashes", consumer.Name)
+			}
+			if keys[strings.ToLower(key)] {
+				return fmt.Errorf("consumer %s: key already used by another consumer", consumer.Name)
+			}
+			keys[strings.ToLower(key)] = true
+		}
+		for key := range consumer.Metadata {
+			// Metadata keys name the headers they are forwarded in.
+			if key == "" || strings.Trim(strings.ToLower(key), "0123456789abcdefghijklmnopqrstuvwxyz-_") != "" {
+				return fmt.Errorf("consumer %s: metadata keys may only contain letters, digits, - and _", consumer.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func validateJWT(jwt *JWT) error {
+	if jwt == nil || jwt.Disabled {
+		return nil
+	}
+	if jwt.Secret == "" && len(jwt.KeyFiles) == 0 && jwt.JWKSURL == "" {
+		return fmt.Errorf("one of secret, keyFiles or jwksUrl must be set")
+	}
+	for _, alg := range jwt.Algorithms {
+		if !slices.Contains(JWTHMACAlgorithms, alg) && !slices.Contains(JWTAsymmetricAlgorithms, alg) {
+			return fmt.Errorf("unknown algorithm %q", alg)
+		}
+	}
+	return nil
+}
+
+func validateClientAuth(vhost Vhost) error {
+	var clientAuth *ClientAuth
+	if vhost.TLS != nil {
+		clientAuth = vhost.TLS.ClientAuth
+	}
+	if clientAuth != nil {
+		switch clientAuth.Mode {
+		case ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+		case ClientAuthVerify:
+			if clientAuth.CAFile == "" {
+				return fmt.Errorf("tls: clientAuth: caFile must be set in verify mode")
+			}
+		default:
+			return fmt.Errorf("tls: clientAuth: unknown mode %q", clientAuth.Mode)
+		}
+	}
+
+	// Endpoints can only rely on certificates verified against the CAs of the vhost.
+	verified := clientAuth != nil && clientAuth.CAFile != "" &&
+		(clientAuth.Mode == ClientAuthRequest || clientAuth.Mode == ClientAuthVerify)
+	for _, endpoint := range vhost.Endpoints {
+		if endpoint.ClientCert != nil && !verified {
+			return fmt.Errorf("endpoint %s: clientCert requires client certificates to be verified by the vhost", endpoint.Path)
+		}
+	}
+	return nil
+}
+
+func validateForwardAuth(fa *ForwardAuth) error {
+	if fa == nil {
+		return nil
+	}
+	if fa.URL == "" {
+		return fmt.Errorf("url must be set")
+	}
+	if u, err := url.Parse(fa.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", fa.URL)
+	}
+	if fa.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if fa.Cache == nil {
+		return nil
+	}
+	if len(fa.Cache.Key) == 0 {
+		return fmt.Errorf("cache key must be set")
+	}
+	for _, part := range fa.Cache.Key {
+		switch {
+		case part == ForwardAuthKeyMethod, part == ForwardAuthKeyHost, part == ForwardAuthKeyPath, part == ForwardAuthKeyQuery:
+		case strings.HasPrefix(part, "header.") && len(part) > len("header."):
+		case strings.HasPrefix(part, "cookie.") && len(part) > len("cookie."):
+		default:
+			return fmt.Errorf("unknown cache key part %q", part)
+		}
+	}
+	if fa.Cache.TTL <= 0 {
+		return fmt.Errorf("cache ttl must be positive")
+	}
+	if fa.Cache.MaxEntries < 0 {
+		return fmt.Errorf("cache maxEntries must not be negative")
+	}
+	return nil
+}
+
+func validateTracing(tracing *Tracing) error {
+	if tracing == nil {
+		return nil
+	}
+	switch tracing.Exporter {
+	case ExporterOTLPGRPC, ExporterOTLPHTTP:
+	default:
+		return fmt.Errorf("unknown exporter %q", tracing.Exporter)
+	}
+	if ratio := tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		return fmt.Errorf("sampleRatio must be between 0 and 1")
+	}
+	for _, propagator := range tracing.Propagators {
+		switch propagator {
+		case PropagatorTraceContext, PropagatorBaggage, PropagatorB3, PropagatorB3Multi:
+		default:
+			return fmt.Errorf("unknown propagator %q", propagator)
+		}
+	}
+	return nil
+}
+
+// validateLog checks the log level and format of the log settings.
+func validateLog(log *Log) error {
+	if log == nil {
+		return nil
+	}
+	switch log.Format {
+	case "", LogFormatJSON, LogFormatText, LogFormatLogfmt:
+	default:
+		return fmt.Errorf("unknown format %q", log.Format)
+	}
+	if log.Level == "" {
+		return nil
+	}
+	for _, level := range logLevels {
+		if strings.EqualFold(log.Level, level) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown level %q", log.Level)
+}
+
+func validateAccessLog(log *AccessLog) error {
+	if log == nil {
+		return nil
+	}
+	switch log.Format {
+	case "", AccessLogJSON, AccessLogCommon, AccessLogCombined:
+	case AccessLogTemplate:
+		if log.Template == "" {
+			return fmt.Errorf("template format needs a template")
+		}
+	default:
+		return fmt.Errorf("unknown format %q", log.Format)
+	}
+	if ratio := log.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		return fmt.Errorf("sampleRatio must be between 0 and 1")
+	}
+	if r := log.Rotation; r != nil && (r.MaxSize < 0 || r.MaxBackups < 0) {
+		return fmt.Errorf("rotation maxSize and maxBackups must not be negative")
+	}
+	return nil
+}
+
+// ParseNetworks parses a list of IP addresses and CIDR ranges. Single addresses are
+// turned into networks containing only themselves.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_replaceEnvVars(t *testing.T) {
@@ -131,6 +133,15 @@ func Test_replaceEnvVars(t *testing.T) {
 			envName:  "path",
 			envValue: "test",
 		},
+		{
+			name: "placeholders",
+			args: args{
+				rawConfig: []byte(`{"url": "http://${HOST}/users/${param.id}?tenant=${header.X-Tenant}&${query}&host=${host}"}`),
+			},
+			want:     []byte(`{"url": "http://backend/users/${param.id}?tenant=${header.X-Tenant}&${query}&host=${host}"}`),
+			envName:  "HOST",
+			envValue: "backend",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -197,3 +208,106 @@ func Test_checkVhostsWithTLS(t *testing.T) {
 		})
 	}
 }
+
+func Test_validateConsumers(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name      string
+		consumers []Consumer
+		wantErr   bool
+	}{
+		{name: "valid", consumers: []Consumer{{Name: "mobile", Keys: []string{hash}}}},
+		{name: "no name", consumers: []Consumer{{Keys: []string{hash}}}, wantErr: true},
+		{name: "no keys", consumers: []Consumer{{Name: "mobile"}}, wantErr: true},
+		{name: "plain key", consumers: []Consumer{{Name: "mobile", Keys: []string{"secret"}}}, wantErr: true},
+		{name: "duplicate name", consumers: []Consumer{{Name: "mobile", Keys: []string{hash}}, {Name: "mobile", Keys: []string{strings.Repeat("cd", 32)}}}, wantErr: true},
+		{name: "shared key", consumers: []Consumer{{Name: "mobile", Keys: []string{hash}}, {Name: "web", Keys: []string{strings.ToUpper(hash)}}}, wantErr: true},
+		{name: "metadata", consumers: []Consumer{{Name: "mobile", Keys: []string{hash}, Metadata: map[string]string{"team": "apps", "cost-center": "42"}}}},
+		{name: "metadata key not a header name", consumers: []Consumer{{Name: "mobile", Keys: []string{hash}, Metadata: map[string]string{"cost center": "42"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateConsumers(tt.consumers); (err != nil) != tt.wantErr {
+				t.Errorf("validateConsumers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateForwardAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		fa      *ForwardAuth
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "valid", fa: &ForwardAuth{URL: "http://auth:8080/verify"}},
+		{name: "no url", fa: &ForwardAuth{}, wantErr: true},
+		{name: "relative url", fa: &ForwardAuth{URL: "/verify"}, wantErr: true},
+		{name: "cache", fa: &ForwardAuth{URL: "http://auth/verify", Cache: &ForwardAuthCache{Key: []string{"method", "path", "header.Authorization", "cookie.session"}, TTL: Duration(time.Minute)}}},
+		{name: "cache without key", fa: &ForwardAuth{URL: "http://auth/verify", Cache: &ForwardAuthCache{TTL: Duration(time.Minute)}}, wantErr: true},
+		{name: "unknown key part", fa: &ForwardAuth{URL: "http://auth/verify", Cache: &ForwardAuthCache{Key: []string{"body"}, TTL: Duration(time.Minute)}}, wantErr: true},
+		{name: "empty header key part", fa: &ForwardAuth{URL: "http://auth/verify", Cache: &ForwardAuthCache{Key: []string{"header."}, TTL: Duration(time.Minute)}}, wantErr: true},
+		{name: "cache without ttl", fa: &ForwardAuth{URL: "http://auth/verify", Cache: &ForwardAuthCache{Key: []string{"path"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateForwardAuth(tt.fa); (err != nil) != tt.wantErr {
+				t.Errorf("validateForwardAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateWebSocket(t *testing.T) {
+	level := func(l int) *int { return &l }
+	tests := []struct {
+		name    string
+		ws      *WebSocketConfig
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "default level", ws: &WebSocketConfig{Compression: &WebSocketCompression{Client: true}}},
+		{name: "no compression", ws: &WebSocketConfig{Compression: &WebSocketCompression{Client: true, Level: level(0)}}},
+		{name: "huffman only", ws: &WebSocketConfig{Compression: &WebSocketCompression{Client: true, Level: level(-2)}}},
+		{name: "level too high", ws: &WebSocketConfig{Compression: &WebSocketCompression{Client: true, Level: level(10)}}, wantErr: true},
+		{name: "negative threshold", ws: &WebSocketConfig{Compression: &WebSocketCompression{Client: true, Threshold: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateWebSocket(tt.ws); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebSocket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateClientAuth(t *testing.T) {
+	withClientAuth := func(clientAuth *ClientAuth, endpoints ...Endpoint) Vhost {
+		return Vhost{TLS: &TLSConfig{Cert: "cert.pem", Key: "key.pem", ClientAuth: clientAuth}, Endpoints: endpoints}
+	}
+	restricted := Endpoint{Path: "/admin", ClientCert: &ClientCertPolicy{AllowedSubjects: []string{"CN=ops"}}}
+
+	tests := []struct {
+		name    string
+		vhost   Vhost
+		wantErr bool
+	}{
+		{name: "no tls", vhost: Vhost{}},
+		{name: "none", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthNone})},
+		{name: "require", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthRequire})},
+		{name: "verify", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthVerify, CAFile: "ca.pem"}, restricted)},
+		{name: "request with CAs", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthRequest, CAFile: "ca.pem"}, restricted)},
+		{name: "verify without CAs", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthVerify}), wantErr: true},
+		{name: "unknown mode", vhost: withClientAuth(&ClientAuth{Mode: "optional"}), wantErr: true},
+		{name: "endpoint policy without client auth", vhost: Vhost{Endpoints: []Endpoint{restricted}}, wantErr: true},
+		{name: "endpoint policy with unverified certificates", vhost: withClientAuth(&ClientAuth{Mode: ClientAuthRequire}, restricted), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateClientAuth(tt.vhost); (err != nil) != tt.wantErr {
+				t.Errorf("validateClientAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultPath is the configuration file read when no other path is given.
+const DefaultPath = "config.json"
+
+// fragment is the content of a configuration file pulled in by an include pattern.
+type fragment struct {
+	Vhosts map[string]Vhost `json:"vhosts"`
+}
+
+// readFile reads a configuration file into v. The format is chosen from the file
+// extension: JSON by default, YAML for .yaml and .yml, and TOML for .toml. Every format
+// is converted to JSON first, so that a single set of field names applies to all of them.
+func readFile(path string, v interface{}) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	raw, err = toJSON(path, replaceEnvVars(raw))
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	if err = json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+func toJSON(path string, raw []byte) ([]byte, error) {
+	var doc map[string]interface{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return raw, nil
+	}
+
+	return json.Marshal(doc)
+}
+
+// loadIncludes merges the vhosts of the files matched by the include patterns of the
+// configuration. Patterns are relative to the directory of the main configuration file,
+// matched files are merged in lexical order, and a vhost may only be defined once.
+// Relative paths of the vhosts are resolved against the directory of their file.
+func loadIncludes(path string, config *Config) error {
+	base := filepath.Dir(path)
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(base, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %s: %w", pattern, err)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+
+		// Watch the directory as well, so that added and removed files are noticed.
+		config.Files = append(config.Files, filepath.Dir(pattern))
+	}
+	sort.Strings(files)
+
+	if config.Vhosts == nil {
+		config.Vhosts = make(map[string]Vhost)
+	}
+	origins := make(map[string]string, len(config.Vhosts))
+	for name, vhost := range config.Vhosts {
+		origins[name] = path
+		resolvePaths(vhost, base)
+	}
+
+	for _, file := range files {
+		var f fragment
+		if err := readFile(file, &f); err != nil {
+			return err
+		}
+		for name, vhost := range f.Vhosts {
+			if origin, ok := origins[name]; ok {
+				return fmt.Errorf("configuration error: vhost %s is defined in both %s and %s", name, origin, file)
+			}
+			origins[name] = file
+			resolvePaths(vhost, filepath.Dir(file))
+			config.Vhosts[name] = vhost
+		}
+		config.Files = append(config.Files, file)
+	}
+	return nil
+}
+
+// resolvePaths makes the relative htpasswd files of the vhost and its endpoints relative
+// to the directory of the configuration file defining the vhost, rather than to the
+// working directory of the process.
+func resolvePaths(vhost Vhost, dir string) {
+	resolve := func(basicAuth *BasicAuth) {
+		if basicAuth != nil && basicAuth.HtpasswdFile != "" && !filepath.IsAbs(basicAuth.HtpasswdFile) {
+			basicAuth.HtpasswdFile = filepath.Join(dir, basicAuth.HtpasswdFile)
+		}
+	}
+	resolve(vhost.BasicAuth)
+	for _, endpoint := range vhost.Endpoints {
+		resolve(endpoint.BasicAuth)
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestGetConfigFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			content: `{"apiGateway": {"name": "gw"}, "vhosts": {"*": {"endpoints": [
+				{"path": "/api", "methods": ["GET"], "backend": {"url": "http://backend${path}", "timeout": 5}}
+			]}}}`,
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `
+apiGateway:
+  name: gw
+vhosts:
+  "*":
+    endpoints:
+      - path: /api
+        methods: [GET]
+        backend:
+          url: http://backend${path}
+          timeout: 5
+`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `
+[apiGateway]
+name = "gw"
+
+[[vhosts."*".endpoints]]
+path = "/api"
+methods = ["GET"]
+
+[vhosts."*".endpoints.backend]
+url = "http://backend${path}"
+timeout = 5
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{tt.file: tt.content})
+
+			cfg, err := GetConfig(filepath.Join(dir, tt.file))
+			if err != nil {
+				t.Fatalf("GetConfig() error = %v", err)
+			}
+			endpoints := cfg.Vhosts["*"].Endpoints
+			if cfg.APIGateway.Name != "gw" || len(endpoints) != 1 {
+				t.Fatalf("GetConfig() = %+v", cfg)
+			}
+			if endpoints[0].Backend.URL != "http://backend${path}" || endpoints[0].Backend.Timeout != 5 {
+				t.Errorf("GetConfig() backend = %+v", endpoints[0].Backend)
+			}
+		})
+	}
+}
+
+func TestGetConfigIncludes(t *testing.T) {
+	backend := `"endpoints": [{"path": "/", "methods": ["GET"], "backend": {"url": "http://backend"}}]`
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "merged",
+			files: map[string]string{
+				"config.json":      `{"include": ["conf.d/*"], "vhosts": {"a.com": {` + backend + `}}}`,
+				"conf.d/b.json":    `{"vhosts": {"b.com": {` + backend + `}}}`,
+				"conf.d/c.yaml":    "vhosts:\n  c.com:\n    endpoints: []\n",
+				"conf.d/ignored/x": "",
+			},
+			want: []string{"a.com", "b.com", "c.com"},
+		},
+		{
+			name: "conflict",
+			files: map[string]string{
+				"config.json":   `{"include": ["conf.d/*.json"], "vhosts": {"a.com": {` + backend + `}}}`,
+				"conf.d/a.json": `{"vhosts": {"a.com": {` + backend + `}}}`,
+			},
+			wantErr: "vhost a.com is defined in both",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+
+			cfg, err := GetConfig(filepath.Join(dir, "config.json"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetConfig() error = %v", err)
+			}
+			for _, name := range tt.want {
+				if _, ok := cfg.Vhosts[name]; !ok {
+					t.Errorf("GetConfig() is missing vhost %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestGetConfigWatchesHtpasswd(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.json": `{"vhosts": {"a.com": {"basicAuth": {"htpasswdFile": "/etc/gateh8/.htpasswd"}, "endpoints": [` +
+			`{"path": "/", "methods": ["GET"], "backend": {"url": "http://backend"}, "basicAuth": {"htpasswdFile": "/etc/gateh8/.htpasswd"}}]}}}`,
+	})
+
+	cfg, err := GetConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("GetConfig() error = %v", err)
+	}
+	want := []string{filepath.Join(dir, "config.json"), "/etc/gateh8/.htpasswd"}
+	if strings.Join(cfg.Files, ",") != strings.Join(want, ",") {
+		t.Errorf("Files = %v, want %v", cfg.Files, want)
+	}
+}
+
+func TestGetConfigResolvesHtpasswd(t *testing.T) {
+	endpoint := `"endpoints": [{"path": "/", "methods": ["GET"], "backend": {"url": "http://backend"}, "basicAuth": {"htpasswdFile": "users/.htpasswd"}}]`
+	dir := writeFiles(t, map[string]string{
+		"config.json":       `{"include": ["conf.d/*.json"], "vhosts": {"a.com": {"basicAuth": {"htpasswdFile": ".htpasswd"}, ` + endpoint + `}}}`,
+		"conf.d/b.com.json": `{"vhosts": {"b.com": {"basicAuth": {"htpasswdFile": "/etc/gateh8/.htpasswd"}, ` + endpoint + `}}}`,
+	})
+
+	cfg, err := GetConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("GetConfig() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "vhost", got: cfg.Vhosts["a.com"].BasicAuth.HtpasswdFile, want: filepath.Join(dir, ".htpasswd")},
+		{name: "endpoint", got: cfg.Vhosts["a.com"].Endpoints[0].BasicAuth.HtpasswdFile, want: filepath.Join(dir, "users/.htpasswd")},
+		{name: "absolute", got: cfg.Vhosts["b.com"].BasicAuth.HtpasswdFile, want: "/etc/gateh8/.htpasswd"},
+		{name: "included endpoint", got: cfg.Vhosts["b.com"].Endpoints[0].BasicAuth.HtpasswdFile, want: filepath.Join(dir, "conf.d/users/.htpasswd")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("htpasswdFile = %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VhostMatcher resolves host names to the vhosts of a configuration. Exact names take
+// precedence over wildcard patterns, which are tried from the longest to the shortest,
+// then in lexical order, so that a host always resolves to the same vhost.
+type VhostMatcher struct {
+	exact    map[string]bool
+	patterns []string
+}
+
+// NewVhostMatcher creates a matcher for the vhost names and patterns.
+func NewVhostMatcher(vhosts ...string) *VhostMatcher {
+	m := &VhostMatcher{exact: make(map[string]bool)}
+	for _, vhost := range vhosts {
+		m.Add(vhost)
+	}
+	return m
+}
+
+// Add adds a vhost name or pattern to the matcher.
+func (m *VhostMatcher) Add(vhost string) {
+	if !strings.ContainsAny(vhost, `*?[\`) {
+		m.exact[vhost] = true
+		return
+	}
+	m.patterns = append(m.patterns, vhost)
+	sort.Slice(m.patterns, func(i, j int) bool {
+		if len(m.patterns[i]) != len(m.patterns[j]) {
+			return len(m.patterns[i]) > len(m.patterns[j])
+		}
+		return m.patterns[i] < m.patterns[j]
+	})
+}
+
+// Match returns the vhost the host name resolves to.
+func (m *VhostMatcher) Match(host string) (string, bool) {
+	if m.exact[host] {
+		return host, true
+	}
+	for _, pattern := range m.patterns {
+		if match, _ := filepath.Match(pattern, host); match {
+			return pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestVhostMatcher(t *testing.T) {
+	m := NewVhostMatcher("*.example.com", "api.example.com", "*.eu.example.com", "*", "v?.example.com")
+
+	tests := []struct {
+		host      string
+		want      string
+		wantMatch bool
+	}{
+		{host: "api.example.com", want: "api.example.com", wantMatch: true},
+		{host: "www.example.com", want: "*.example.com", wantMatch: true},
+		{host: "shop.eu.example.com", want: "*.eu.example.com", wantMatch: true},
+		{host: "v2.example.com", want: "v?.example.com", wantMatch: true},
+		{host: "other.org", want: "*", wantMatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			// Overlapping patterns resolve the same way every time.
+			for i := 0; i < 10; i++ {
+				got, ok := m.Match(tt.host)
+				if got != tt.want || ok != tt.wantMatch {
+					t.Fatalf("Match(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.wantMatch)
+				}
+			}
+		})
+	}
+
+	if _, ok := NewVhostMatcher("api.example.com").Match("www.example.com"); ok {
+		t.Error("Match() matched an unknown host")
+	}
+}
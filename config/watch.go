@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls the files returned by paths and calls onChange whenever one of them is
+// created, removed, or changes size or modification time, until the context is cancelled.
+// Paths are re-evaluated on every poll, so that the watched set can follow reloads. Only
+// the files watched by both polls are compared: a file entering or leaving the set is
+// the outcome of a change to another file, such as the one including it, and onChange
+// may apply that change after the next poll.
+func Watch(ctx context.Context, interval time.Duration, paths func() []string, onChange func()) {
+	last := versions(paths())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := versions(paths())
+		if changed(last, current) {
+			onChange()
+		}
+		last = current
+	}
+}
+
+// version identifies a version of a file by its modification time and size.
+type version struct {
+	modTime int64
+	size    int64
+}
+
+// versions returns the current version of every file, using the zero version for files that cannot be read.
+func versions(paths []string) map[string]version {
+	v := make(map[string]version, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			v[path] = version{}
+			continue
+		}
+		v[path] = version{modTime: info.ModTime().UnixNano(), size: info.Size()}
+	}
+	return v
+}
+
+// changed reports whether one of the files of both versions changed between them.
+func changed(last, current map[string]version) bool {
+	for path, v := range current {
+		if w, ok := last[path]; ok && v != w {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchAddedInclude(t *testing.T) {
+	backend := `"endpoints": [{"path": "/", "methods": ["GET"], "backend": {"url": "http://backend"}}]`
+	dir := writeFiles(t, map[string]string{
+		"config.json": `{"vhosts": {"a.com": {` + backend + `}}}`,
+	})
+	path := filepath.Join(dir, "config.json")
+
+	cfg, err := GetConfig(path)
+	if err != nil {
+		t.Fatalf("GetConfig() error = %v", err)
+	}
+	var (
+		mu      sync.Mutex
+		files   = cfg.Files
+		reloads int
+		wg      sync.WaitGroup
+	)
+	paths := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return files
+	}
+	// Like the gateway, reload in the background, after the watcher has moved on.
+	onChange := func() {
+		mu.Lock()
+		reloads++
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(15 * time.Millisecond)
+			cfg, err := GetConfig(path)
+			if err != nil {
+				t.Errorf("GetConfig() error = %v", err)
+				return
+			}
+			mu.Lock()
+			files = cfg.Files
+			mu.Unlock()
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		Watch(ctx, 10*time.Millisecond, paths, onChange)
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "b.json"), []byte(`{"vhosts": {"b.com": {`+backend+`}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The configuration is replaced at once, so that it is never read half-written.
+	if err := os.WriteFile(path+".new", []byte(`{"include": ["conf.d/*.json"], "vhosts": {"a.com": {`+backend+`}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	cancel()
+	<-watching
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(files) != 3 {
+		t.Errorf("Files = %v, want the configuration, the include directory and the included file", files)
+	}
+	if reloads != 1 {
+		t.Errorf("reloads = %d, want 1", reloads)
+	}
+}
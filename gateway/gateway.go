@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/yarlson/GateH8/auth"
+	"github.com/yarlson/GateH8/client"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/proxy"
+	"github.com/yarlson/GateH8/router"
+	"github.com/yarlson/GateH8/upstream"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// state is everything built from a single version of the configuration.
+type state struct {
+	config       *config.Config
+	registry     *upstream.Registry
+	transports   *client.Transports
+	accessLog    *logger.AccessLog
+	router       *router.Router
+	certificates map[string]*tls.Certificate
+	// tlsConfigs are the TLS settings of the vhosts authenticating their clients by certificate.
+	tlsConfigs map[string]*tls.Config
+	// vhosts resolves the server names of the TLS handshakes to vhosts, like the router
+	// resolves the hosts of the requests.
+	vhosts *config.VhostMatcher
+}
+
+// Gateway serves requests with the routes built from the current configuration, and
+// lets that configuration be replaced at runtime without dropping connections.
+// Requests already dispatched, including WebSocket sessions, finish on the routes
+// they started with.
+type Gateway struct {
+	reloadMu    sync.Mutex
+	current     atomic.Pointer[state]
+	sessions    *client.Sessions
+	maintenance *proxy.Maintenance
+}
+
+// New builds a Gateway from the configuration and starts the health checks of its backends.
+func New(cfg *config.Config) (*Gateway, error) {
+	g := &Gateway{
+		sessions:    client.NewSessions(),
+		maintenance: proxy.NewMaintenance(),
+	}
+
+	s, err := g.build(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	g.current.Store(s)
+	s.registry.Start()
+	return g, nil
+}
+
+// build builds the state of the configuration. The upstream clients of the previous
+// state, if any, are taken over when unchanged.
+func (g *Gateway) build(cfg *config.Config, previous *state) (*state, error) {
+	s := &state{
+		config:       cfg,
+		registry:     upstream.NewRegistry(),
+		certificates: make(map[string]*tls.Certificate),
+		tlsConfigs:   make(map[string]*tls.Config),
+		vhosts:       config.NewVhostMatcher(),
+	}
+
+	// Certificates are loaded up front, so that a broken one fails the (re)load
+	// instead of every TLS handshake.
+	for vhostName, vhost := range cfg.Vhosts {
+		if vhost.TLS == nil {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(vhost.TLS.Cert, vhost.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate of vhost %s: %w", vhostName, err)
+		}
+		s.certificates[vhostName] = &cert
+		s.vhosts.Add(vhostName)
+
+		if clientAuth := vhost.TLS.ClientAuth; clientAuth != nil && clientAuth.Mode != config.ClientAuthNone {
+			tlsConfig, err := clientAuthConfig(clientAuth, &cert)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client CAs of vhost %s: %w", vhostName, err)
+			}
+			s.tlsConfigs[vhostName] = tlsConfig
+		}
+	}
+
+	accessLog, err := logger.NewAccessLog(cfg.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	s.accessLog = accessLog
+
+	var previousTransports *client.Transports
+	if previous != nil {
+		previousTransports = previous.transports
+	}
+	s.transports = client.NewTransports(previousTransports)
+
+	s.router, err = router.NewRouter(cfg, s.registry, s.transports, g.sessions, g.maintenance, s.accessLog)
+	if err != nil {
+		_ = s.accessLog.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload builds new routes from the configuration and atomically swaps them in.
+// The previous configuration stays in use if the new one cannot be applied.
+func (g *Gateway) Reload(cfg *config.Config) error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	old := g.current.Load()
+	if cfg.UseTLS != old.config.UseTLS {
+		return fmt.Errorf("switching between TLS and plain HTTP requires a restart")
+	}
+
+	s, err := g.build(cfg, old)
+	if err != nil {
+		return err
+	}
+
+	s.registry.Inherit(old.registry)
+	s.registry.Start()
+	g.current.Store(s)
+	old.registry.Close()
+	old.transports.CloseUnused(s.transports)
+	_ = old.accessLog.Close()
+	return nil
+}
+
+// Config returns the configuration currently in use.
+func (g *Gateway) Config() *config.Config {
+	return g.current.Load().config
+}
+
+// Registry returns the upstream registry of the configuration currently in use.
+func (g *Gateway) Registry() *upstream.Registry {
+	return g.current.Load().registry
+}
+
+// Routes returns the route table of every vhost of the configuration currently in use.
+func (g *Gateway) Routes() map[string][]router.Route {
+	return g.current.Load().router.RouteTable()
+}
+
+// Maintenance returns the vhosts in maintenance mode. The mode is shared by every configuration.
+func (g *Gateway) Maintenance() *proxy.Maintenance {
+	return g.maintenance
+}
+
+// Sessions returns the live WebSocket sessions. They are shared by every configuration.
+func (g *Gateway) Sessions() *client.Sessions {
+	return g.sessions
+}
+
+// ServeHTTP dispatches the request to the routes of the current configuration.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.current.Load().router.ServeHTTP(w, r)
+}
+
+// GetCertificate returns the certificate of the vhost matching the requested server name.
+// It is meant to be used as tls.Config.GetCertificate.
+func (g *Gateway) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s := g.current.Load()
+	if vhost, ok := s.vhosts.Match(info.ServerName); ok {
+		return s.certificates[vhost], nil
+	}
+	return nil, fmt.Errorf("no certificate for given hostname: %s", info.ServerName)
+}
+
+// GetConfigForClient returns the TLS settings of the vhost matching the requested server
+// name if it authenticates its clients by certificate, or nil to use the default settings.
+// It is meant to be used as tls.Config.GetConfigForClient.
+func (g *Gateway) GetConfigForClient(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	s := g.current.Load()
+	if vhost, ok := s.vhosts.Match(info.ServerName); ok {
+		return s.tlsConfigs[vhost], nil
+	}
+	return nil, nil
+}
+
+// clientAuthConfig builds the TLS settings of a vhost authenticating its clients by certificate.
+func clientAuthConfig(clientAuth *config.ClientAuth, cert *tls.Certificate) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		// The settings replace the ones of the server, which would otherwise negotiate HTTP/2.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if clientAuth.CAFile != "" {
+		var err error
+		if tlsConfig.ClientCAs, err = auth.ReadClientCAs(clientAuth.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	switch clientAuth.Mode {
+	case config.ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		if tlsConfig.ClientCAs != nil {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	case config.ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case config.ClientAuthVerify:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Close stops the background tasks of the current configuration and closes the idle upstream connections.
+func (g *Gateway) Close() {
+	s := g.current.Load()
+	s.registry.Close()
+	_ = s.accessLog.Close()
+	s.transports.CloseIdleConnections()
+}
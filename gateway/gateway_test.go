@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/yarlson/GateH8/config"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate from the template, signed by the parent, or self-signed if
+// the parent is nil, and writes it along with its key to the directory.
+func issue(t *testing.T, dir, name string, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signerCert, signerKey := template, interface{}(key)
+	if parent != nil {
+		signerCert, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+func TestClientCertificateVhosts(t *testing.T) {
+	dir := t.TempDir()
+	caTemplate := func(name string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	}
+	clientTemplate := func(name string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: name}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	}
+	issue(t, dir, "server", &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"a.example.com", "b.example.com", "public.example.com"}}, nil)
+	issue(t, dir, "ca-a", caTemplate("CA A"), nil)
+	caB := issue(t, dir, "ca-b", caTemplate("CA B"), nil)
+	clientB := issue(t, dir, "client-b", clientTemplate("client-b"), &caB)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	vhost := func(mode, ca string) config.Vhost {
+		tlsConfig := &config.TLSConfig{Cert: filepath.Join(dir, "server.pem"), Key: filepath.Join(dir, "server.key")}
+		if mode != "" {
+			tlsConfig.ClientAuth = &config.ClientAuth{Mode: mode, CAFile: filepath.Join(dir, ca+".pem")}
+		}
+		return config.Vhost{
+			TLS:       tlsConfig,
+			Endpoints: []config.Endpoint{{Path: "/", Methods: []string{http.MethodGet}, Backend: &config.Backend{URL: backend.URL}}},
+		}
+	}
+	gw, err := New(&config.Config{UseTLS: true, Vhosts: map[string]config.Vhost{
+		"a.example.com": vhost(config.ClientAuthVerify, "ca-a"),
+		"b.example.com": vhost(config.ClientAuthVerify, "ca-b"),
+		// The wildcard must not take over the TLS settings of the vhosts above.
+		"*.example.com": vhost("", ""),
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer gw.Close()
+
+	srv := httptest.NewUnstartedServer(gw)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{GetCertificate: gw.GetCertificate, GetConfigForClient: gw.GetConfigForClient}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		sni        string
+		host       string
+		cert       bool
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "same vhost", sni: "b.example.com", host: "b.example.com", cert: true, wantStatus: http.StatusOK},
+		{name: "certificate of another vhost's CA", sni: "b.example.com", host: "a.example.com", cert: true, wantStatus: http.StatusMisdirectedRequest},
+		{name: "connection of a vhost without client auth", sni: "public.example.com", host: "b.example.com", wantStatus: http.StatusMisdirectedRequest},
+		{name: "no certificate", sni: "b.example.com", host: "b.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true}
+			if tt.cert {
+				tlsConfig.Certificates = []tls.Certificate{clientB}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+			defer client.CloseIdleConnections()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+			req.Host = tt.host
+			resp, err := client.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEndpointJWTDisabled(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	endpoint := func(path string, jwt *config.JWT) config.Endpoint {
+		return config.Endpoint{Path: path, Methods: []string{http.MethodGet}, JWT: jwt, Backend: &config.Backend{URL: backend.URL}}
+	}
+	gw, err := New(&config.Config{Vhosts: map[string]config.Vhost{
+		"api.example.com": {
+			JWT: &config.JWT{Secret: "secret"},
+			Endpoints: []config.Endpoint{
+				endpoint("/private", nil),
+				endpoint("/health", &config.JWT{Disabled: true}),
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer gw.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "vhost validation", path: "/private", wantStatus: http.StatusUnauthorized},
+		{name: "validation turned off", path: "/health", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://api.example.com"+tt.path, nil)
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
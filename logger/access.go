@@ -0,0 +1,390 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Fields of the access log entries. The JSON entries carry DefaultAccessLogFields
+// unless configured otherwise, and templates can use all of them.
+const (
+	FieldTime             = "time"
+	FieldRequestID        = "request_id"
+	FieldRemoteAddr       = "remote_addr"
+	FieldUser             = "user"
+	FieldConsumer         = "consumer"
+	FieldMethod           = "method"
+	FieldURL              = "url"
+	FieldProto            = "proto"
+	FieldHost             = "host"
+	FieldStatus           = "status"
+	FieldBytes            = "bytes"
+	FieldDuration         = "duration"
+	FieldVhost            = "vhost"
+	FieldEndpoint         = "endpoint"
+	FieldUpstream         = "upstream"
+	FieldUpstreamDuration = "upstream_duration"
+	FieldTLSVersion       = "tls_version"
+	FieldUserAgent        = "user_agent"
+	FieldReferer          = "referer"
+)
+
+// DefaultAccessLogFields are the fields of the JSON access log entries, unless configured otherwise.
+var DefaultAccessLogFields = []string{FieldMethod, FieldURL, FieldRemoteAddr, FieldStatus, FieldBytes, FieldDuration, FieldRequestID}
+
+var accessLogFields = map[string]bool{
+	FieldTime: true, FieldRequestID: true, FieldRemoteAddr: true, FieldUser: true, FieldConsumer: true, FieldMethod: true,
+	FieldURL: true, FieldProto: true, FieldHost: true, FieldStatus: true, FieldBytes: true,
+	FieldDuration: true, FieldVhost: true, FieldEndpoint: true, FieldUpstream: true,
+	FieldUpstreamDuration: true, FieldTLSVersion: true, FieldUserAgent: true, FieldReferer: true,
+}
+
+// redactedHeaders carry credentials, and are always masked.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacted replaces the masked values.
+const redacted = "REDACTED"
+
+// clfTimeFormat is the time format of the Common and Combined Log Formats.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+const logMessage = "HTTP request" // Define a constant for the log message
+
+// AccessLog writes an entry for every request served by the gateway.
+type AccessLog struct {
+	format        string
+	template      *template.Template
+	fields        []string
+	headers       []string
+	redactHeaders map[string]bool
+	redactQuery   map[string]bool
+	sampleRatio   float64
+
+	json   *logrus.Logger
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+// NewAccessLog creates the access log described by the configuration. Without
+// configuration, requests are logged as JSON entries by L.
+func NewAccessLog(cfg *config.AccessLog) (*AccessLog, error) {
+	if cfg == nil {
+		cfg = &config.AccessLog{}
+	}
+
+	l := &AccessLog{
+		format:        cfg.Format,
+		fields:        cfg.Fields,
+		sampleRatio:   1,
+		redactHeaders: make(map[string]bool),
+		redactQuery:   make(map[string]bool),
+	}
+	if l.format == "" {
+		l.format = config.AccessLogJSON
+	}
+	if len(l.fields) == 0 {
+		l.fields = DefaultAccessLogFields
+	}
+	for _, field := range l.fields {
+		if !accessLogFields[field] {
+			return nil, fmt.Errorf("unknown access log field %q", field)
+		}
+	}
+	for _, name := range cfg.Headers {
+		l.headers = append(l.headers, http.CanonicalHeaderKey(name))
+	}
+	if cfg.SampleRatio != nil {
+		l.sampleRatio = *cfg.SampleRatio
+	}
+
+	for _, name := range redactedHeaders {
+		l.redactHeaders[name] = true
+	}
+	if cfg.Redact != nil {
+		for _, name := range cfg.Redact.Headers {
+			l.redactHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+		for _, name := range cfg.Redact.QueryParams {
+			l.redactQuery[name] = true
+		}
+	}
+
+	if l.format == config.AccessLogTemplate {
+		tmpl, err := template.New("accessLog").Option("missingkey=zero").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		l.template = tmpl
+	}
+
+	switch cfg.Output {
+	case "", "stderr":
+		l.out = os.Stderr
+	case "stdout":
+		l.out = os.Stdout
+	default:
+		var maxSize int64
+		var interval time.Duration
+		var maxBackups int
+		if r := cfg.Rotation; r != nil {
+			maxSize, interval, maxBackups = int64(r.MaxSize)<<20, time.Duration(r.Interval), r.MaxBackups
+		}
+		file, err := openRotatingFile(cfg.Output, maxSize, interval, maxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("error opening access log: %w", err)
+		}
+		l.out, l.closer = file, file
+	}
+
+	if l.format == config.AccessLogJSON {
+		if cfg.Output == "" {
+			l.json = L
+		} else {
+			l.json = &logrus.Logger{Out: l.out, Formatter: &logrus.JSONFormatter{}, Hooks: make(logrus.LevelHooks), Level: logrus.InfoLevel}
+		}
+	}
+	return l, nil
+}
+
+// Close closes the file the access log is written to, if any.
+func (l *AccessLog) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// Middleware logs the requests once they are served.
+func (l *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Capture the start time to compute the duration of the request.
+		start := time.Now()
+
+		// Record the details filled in while the request is routed and proxied.
+		rec := &accessRecord{}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey, rec))
+
+		// Wrap the response writer to capture details like status and bytes written.
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		switch {
+		case status == 0 && ww.BytesWritten() == 0 && r.Header.Get("Upgrade") != "":
+			status = http.StatusSwitchingProtocols // The connection was hijacked.
+		case status == 0:
+			status = http.StatusOK
+		}
+		// Server errors are always logged. Other requests are sampled, and not logged at all
+		// for the vhosts whose log level is above info.
+		if status < http.StatusInternalServerError {
+			if l.sampleRatio < 1 && rand.Float64() >= l.sampleRatio {
+				return
+			}
+			if rec.log != nil && !rec.log.IsLevelEnabled(logrus.InfoLevel) {
+				return
+			}
+		}
+
+		l.write(l.entry(r, rec, start, status, ww.BytesWritten()))
+	})
+}
+
+// entry collects all the fields of the request.
+func (l *AccessLog) entry(r *http.Request, rec *accessRecord, start time.Time, status, size int) map[string]interface{} {
+	user := rec.user
+	if user == "" {
+		user, _, _ = r.BasicAuth()
+	}
+	endpoint := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		endpoint = rctx.RoutePattern()
+	}
+	tlsVersion := ""
+	if r.TLS != nil {
+		tlsVersion = tls.VersionName(r.TLS.Version)
+	}
+
+	entry := map[string]interface{}{
+		FieldTime:             start,
+		FieldRequestID:        middleware.GetReqID(r.Context()),
+		FieldRemoteAddr:       r.RemoteAddr,
+		FieldUser:             user,
+		FieldConsumer:         rec.consumer,
+		FieldMethod:           r.Method,
+		FieldURL:              l.redactURL(r.URL),
+		FieldProto:            r.Proto,
+		FieldHost:             r.Host,
+		FieldStatus:           status,
+		FieldBytes:            size,
+		FieldDuration:         time.Since(start).Seconds() * 1000,
+		FieldVhost:            rec.vhost,
+		FieldEndpoint:         endpoint,
+		FieldUpstream:         rec.upstream,
+		FieldUpstreamDuration: rec.upstreamDuration.Seconds() * 1000,
+		FieldTLSVersion:       tlsVersion,
+		FieldUserAgent:        r.UserAgent(),
+		FieldReferer:          r.Referer(),
+	}
+	for _, name := range l.headers {
+		value := r.Header.Get(name)
+		if value != "" && l.redactHeaders[name] {
+			value = redacted
+		}
+		entry["header."+name] = value
+	}
+	return entry
+}
+
+// write formats the entry and writes it to the output.
+func (l *AccessLog) write(entry map[string]interface{}) {
+	if l.format == config.AccessLogJSON {
+		fields := make(logrus.Fields, len(l.fields)+len(l.headers))
+		for _, name := range l.fields {
+			if name != FieldTime { // Added by the formatter.
+				fields[name] = entry[name]
+			}
+		}
+		for _, name := range l.headers {
+			fields["header."+name] = entry["header."+name]
+		}
+		l.json.WithFields(fields).Info(logMessage)
+		return
+	}
+
+	var line bytes.Buffer
+	switch l.format {
+	case config.AccessLogTemplate:
+		if err := l.template.Execute(&line, entry); err != nil {
+			L.Error("Error formatting access log entry:", err)
+			return
+		}
+		if line.Len() == 0 || line.Bytes()[line.Len()-1] != '\n' {
+			line.WriteByte('\n')
+		}
+	default:
+		writeCLF(&line, entry, l.format == config.AccessLogCombined)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line.Bytes()); err != nil {
+		L.Error("Error writing access log:", err)
+	}
+}
+
+// writeCLF formats the entry in the Common Log Format, or in the Combined Log Format
+// which adds the referer and the user agent.
+func writeCLF(buf *bytes.Buffer, entry map[string]interface{}, combined bool) {
+	size := "-"
+	if n := entry[FieldBytes].(int); n > 0 {
+		size = strconv.Itoa(n)
+	}
+	fmt.Fprintf(buf, "%s - %s [%s] \"%s %s %s\" %d %s",
+		orDash(entry[FieldRemoteAddr].(string)),
+		orDash(entry[FieldUser].(string)),
+		entry[FieldTime].(time.Time).Format(clfTimeFormat),
+		entry[FieldMethod], escapeCLF(entry[FieldURL].(string)), entry[FieldProto],
+		entry[FieldStatus], size,
+	)
+	if combined {
+		fmt.Fprintf(buf, " \"%s\" \"%s\"",
+			escapeCLF(orDash(entry[FieldReferer].(string))),
+			escapeCLF(orDash(entry[FieldUserAgent].(string))),
+		)
+	}
+	buf.WriteByte('\n')
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func escapeCLF(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`)
+}
+
+// redactURL returns the URL with the values of the redacted query parameters masked.
+func (l *AccessLog) redactURL(u *url.URL) string {
+	if len(l.redactQuery) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+
+	query := u.Query()
+	masked := false
+	for name, values := range query {
+		if l.redactQuery[name] {
+			for i := range values {
+				values[i] = redacted
+			}
+			masked = true
+		}
+	}
+	if !masked {
+		return u.String()
+	}
+
+	redactedURL := *u
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.String()
+}
+
+// accessRecord holds the details of a request that are only known to the handlers.
+type accessRecord struct {
+	vhost            string
+	log              *logrus.Logger
+	user             string
+	consumer         string
+	upstream         string
+	upstreamDuration time.Duration
+}
+
+type contextKey struct {
+	name string
+}
+
+// accessRecordKey is the context key of the accessRecord of a request.
+var accessRecordKey = &contextKey{"accessRecord"}
+
+// RecordUpstream records the address of the upstream target that served the request,
+// and the time it took to answer, in the access log.
+func RecordUpstream(ctx context.Context, addr string, duration time.Duration) {
+	if rec, ok := ctx.Value(accessRecordKey).(*accessRecord); ok {
+		rec.upstream = addr
+		rec.upstreamDuration = duration
+	}
+}
+
+// RecordConsumer records the API consumer that sent the request, in the access log.
+func RecordConsumer(ctx context.Context, consumer string) {
+	if rec, ok := ctx.Value(accessRecordKey).(*accessRecord); ok {
+		rec.consumer = consumer
+	}
+}
+
+// RecordUser records the identity the client authenticated as, in the access log.
+func RecordUser(ctx context.Context, user string) {
+	if rec, ok := ctx.Value(accessRecordKey).(*accessRecord); ok {
+		rec.user = user
+	}
+}
@@ -0,0 +1,183 @@
+package logger
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveLogged serves a request through an access log built from cfg, and returns what it wrote.
+func serveLogged(t *testing.T, cfg *config.AccessLog, req *http.Request, status int) string {
+	return serveLoggedVhost(t, cfg, nil, req, status)
+}
+
+// serveLoggedVhost is serveLogged for a vhost with the given log settings.
+func serveLoggedVhost(t *testing.T, cfg *config.AccessLog, vhostLog *config.Log, req *http.Request, status int) string {
+	cfg.Output = filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := NewAccessLog(cfg)
+	if err != nil {
+		t.Fatalf("NewAccessLog() error = %v", err)
+	}
+	defer accessLog.Close()
+
+	r := chi.NewRouter()
+	r.Use(accessLog.Middleware)
+	r.Use(WithVhost("api.example.com", vhostLog, nil))
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		RecordUpstream(r.Context(), "10.0.0.5:8080", 12*time.Millisecond)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("hello"))
+	})
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	out, err := os.ReadFile(cfg.Output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	return string(out)
+}
+
+func newLoggedRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/users/1?token=secret&page=2", nil)
+	req.RemoteAddr = "192.0.2.1"
+	req.SetBasicAuth("frank", "password")
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("X-Tenant", "acme")
+	return req
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.AccessLog
+		want *regexp.Regexp
+	}{
+		{
+			name: "common",
+			cfg:  &config.AccessLog{Format: config.AccessLogCommon},
+			want: regexp.MustCompile(`^192\.0\.2\.1 - frank \[[^]]+\] "GET /users/1\?token=secret&page=2 HTTP/1\.1" 200 5\n$`),
+		},
+		{
+			name: "combined with redaction",
+			cfg: &config.AccessLog{
+				Format: config.AccessLogCombined,
+				Redact: &config.LogRedaction{QueryParams: []string{"token"}},
+			},
+			want: regexp.MustCompile(`^192\.0\.2\.1 - frank \[[^]]+\] "GET /users/1\?page=2&token=REDACTED HTTP/1\.1" 200 5 "https://example\.com/" "curl/8\.0"\n$`),
+		},
+		{
+			name: "template",
+			cfg: &config.AccessLog{
+				Format:   config.AccessLogTemplate,
+				Template: `{{.vhost}} {{.endpoint}} {{.status}} {{.upstream}} {{.upstream_duration}} {{index . "header.X-Tenant"}}`,
+				Headers:  []string{"x-tenant"},
+			},
+			want: regexp.MustCompile(`^api\.example\.com /users/\{id\} 200 10\.0\.0\.5:8080 12 acme\n$`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveLogged(t, tt.cfg, newLoggedRequest(), http.StatusOK); !tt.want.MatchString(got) {
+				t.Errorf("access log = %q, want match for %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	cfg := &config.AccessLog{
+		Fields:  []string{FieldMethod, FieldStatus, FieldVhost, FieldEndpoint, FieldUpstream},
+		Headers: []string{"X-Tenant", "Authorization"},
+	}
+	out := serveLogged(t, cfg, newLoggedRequest(), http.StatusCreated)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &entry); err != nil {
+		t.Fatalf("access log %q is not JSON: %v", out, err)
+	}
+	want := map[string]interface{}{
+		"msg":                  "HTTP request",
+		"method":               "GET",
+		"status":               float64(201),
+		"vhost":                "api.example.com",
+		"endpoint":             "/users/{id}",
+		"upstream":             "10.0.0.5:8080",
+		"header.X-Tenant":      "acme",
+		"header.Authorization": "REDACTED",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("entry[%s] = %v, want %v", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["url"]; ok {
+		t.Errorf("entry has the url field, which was not selected")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	never := 0.0
+	tests := []struct {
+		name   string
+		status int
+		logged bool
+	}{
+		{name: "success", status: http.StatusOK, logged: false},
+		{name: "server error", status: http.StatusBadGateway, logged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.AccessLog{Format: config.AccessLogCommon, SampleRatio: &never}
+			out := serveLogged(t, cfg, newLoggedRequest(), tt.status)
+			if logged := strings.TrimSpace(out) != ""; logged != tt.logged {
+				t.Errorf("logged = %v, want %v", logged, tt.logged)
+			}
+		})
+	}
+}
+
+func TestAccessLogQuietVhost(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		logged bool
+	}{
+		{name: "success", status: http.StatusOK, logged: false},
+		{name: "server error", status: http.StatusInternalServerError, logged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.AccessLog{Format: config.AccessLogCommon}
+			out := serveLoggedVhost(t, cfg, &config.Log{Level: "warn"}, newLoggedRequest(), tt.status)
+			if logged := strings.TrimSpace(out) != ""; logged != tt.logged {
+				t.Errorf("logged = %v, want %v", logged, tt.logged)
+			}
+		})
+	}
+}
+
+func TestNewAccessLogErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.AccessLog
+	}{
+		{name: "unknown field", cfg: &config.AccessLog{Fields: []string{"nope"}}},
+		{name: "invalid template", cfg: &config.AccessLog{Format: config.AccessLogTemplate, Template: "{{.status"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAccessLog(tt.cfg); err == nil {
+				t.Error("NewAccessLog() error = nil, want error")
+			}
+		})
+	}
+}
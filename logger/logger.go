@@ -1,38 +1,21 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
 	"net/http"
-	"time"
+	"os"
+	"sync/atomic"
 )
 
 // L is a logger instance, utilized throughout the application to output structured logs.
 var L *logrus.Logger
 
-const logMessage = "HTTP request" // Define a constant for the log message
-
-func JsonLogger(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Capture the start time to compute the duration of the request.
-		start := time.Now()
-
-		// Wrap the response writer to capture details like status and bytes written.
-		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
-		next.ServeHTTP(ww, r)
-
-		// Log the request details.
-		L.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"url":         r.URL.String(),
-			"remote_addr": r.RemoteAddr,
-			"status":      ww.Status(),
-			"bytes":       ww.BytesWritten(),
-			"duration":    time.Since(start).Seconds() * 1000,
-			"request_id":  r.Context().Value(middleware.RequestIDKey),
-		}).Info(logMessage)
-	})
-}
+// formatter is the formatter of L, shared by the loggers derived from it, such as the vhost ones.
+var formatter atomic.Pointer[logrus.Formatter]
 
 func GetLogger() *logrus.Logger {
 	return L
@@ -40,5 +23,139 @@ func GetLogger() *logrus.Logger {
 
 func init() {
 	L = logrus.New()
-	L.SetFormatter(&logrus.JSONFormatter{})
+	L.SetFormatter(currentFormatter{})
+	setFormatter(&logrus.JSONFormatter{})
+}
+
+// currentFormatter formats entries with the formatter L is configured with.
+type currentFormatter struct{}
+
+func (currentFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return (*formatter.Load()).Format(entry)
+}
+
+func setFormatter(f logrus.Formatter) {
+	formatter.Store(&f)
+}
+
+// Configure applies the log level and format of the configuration to L. Settings left
+// empty are reset to their defaults: info level and JSON format.
+func Configure(cfg *config.Log) error {
+	if cfg == nil {
+		cfg = &config.Log{}
+	}
+	level, f, err := parse(cfg)
+	if err != nil {
+		return err
+	}
+	L.SetLevel(level)
+	setFormatter(f)
+	return nil
+}
+
+// New creates a logger with the level and format of the configuration. An empty level
+// defaults to the one of the global settings, which L is configured with once they are
+// applied, and an empty format follows the one of L.
+func New(cfg, global *config.Log) (*logrus.Logger, error) {
+	settings := *cfg
+	if settings.Level == "" && global != nil {
+		settings.Level = global.Level
+	}
+	level, f, err := parse(&settings)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Format == "" {
+		f = currentFormatter{}
+	}
+	return &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: f,
+		Hooks:     make(logrus.LevelHooks),
+		Level:     level,
+		ExitFunc:  os.Exit,
+	}, nil
+}
+
+// parse returns the level and the formatter of the configuration.
+func parse(cfg *config.Log) (logrus.Level, logrus.Formatter, error) {
+	level := logrus.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		if level, err = logrus.ParseLevel(cfg.Level); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	switch cfg.Format {
+	case "", config.LogFormatJSON:
+		return level, &logrus.JSONFormatter{}, nil
+	case config.LogFormatText:
+		return level, &logrus.TextFormatter{FullTimestamp: true}, nil
+	case config.LogFormatLogfmt:
+		// Unlike the text format, the output does not depend on the terminal.
+		return level, &logrus.TextFormatter{FullTimestamp: true, DisableColors: true, ForceQuote: true}, nil
+	default:
+		return 0, nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+}
+
+// logEntryKey is the context key of the log entry of a request.
+var logEntryKey = &contextKey{"logEntry"}
+
+// FromContext returns the log entry of a request, which carries its request ID, and
+// the vhost and endpoint serving it once routed.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(logEntryKey).(*logrus.Entry); ok {
+		return entry
+	}
+	entry := logrus.NewEntry(L)
+	if id := middleware.GetReqID(ctx); id != "" {
+		entry = entry.WithField(FieldRequestID, id)
+	}
+	return entry
+}
+
+// NewContext returns a copy of the context carrying the log entry, for the log lines of the
+// request to carry its fields.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, logEntryKey, entry)
+}
+
+// WithVhost is a middleware adding the vhost serving the requests to their log entry and
+// to the access log. The vhost's log settings, if any, override the global ones for its requests.
+func WithVhost(vhost string, cfg, global *config.Log) func(http.Handler) http.Handler {
+	log := L
+	if cfg != nil {
+		var err error
+		if log, err = New(cfg, global); err != nil {
+			L.WithError(err).WithField(FieldVhost, vhost).Error("Invalid vhost log settings, using the defaults")
+			log = L
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := logrus.NewEntry(log).WithField(FieldVhost, vhost)
+			if id := middleware.GetReqID(r.Context()); id != "" {
+				entry = entry.WithField(FieldRequestID, id)
+			}
+			if rec, ok := r.Context().Value(accessRecordKey).(*accessRecord); ok {
+				rec.vhost = vhost
+				rec.log = log
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), entry)))
+		})
+	}
+}
+
+// WithEndpoint is a middleware adding the path template of the endpoint serving the
+// requests to their log entry.
+func WithEndpoint(path string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := FromContext(r.Context()).WithField(FieldEndpoint, path)
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), entry)))
+		})
+	}
 }
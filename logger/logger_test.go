@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureL redirects L to a buffer for the duration of the test, and restores its settings afterwards.
+func captureL(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, level := L.Out, L.GetLevel()
+	L.SetOutput(&buf)
+	t.Cleanup(func() {
+		L.SetOutput(out)
+		_ = Configure(nil)
+		L.SetLevel(level)
+	})
+	return &buf
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *config.Log
+		want    string
+		wantErr bool
+	}{
+		{name: "default", cfg: nil, want: `"msg":"hello"`},
+		{name: "json", cfg: &config.Log{Format: config.LogFormatJSON}, want: `"msg":"hello"`},
+		{name: "text", cfg: &config.Log{Format: config.LogFormatText}, want: `msg=hello`},
+		{name: "logfmt", cfg: &config.Log{Format: config.LogFormatLogfmt}, want: `level="info" msg="hello"`},
+		{name: "quiet", cfg: &config.Log{Level: "warn"}, want: ""},
+		{name: "unknown level", cfg: &config.Log{Level: "loud"}, wantErr: true},
+		{name: "unknown format", cfg: &config.Log{Format: "xml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureL(t)
+			err := Configure(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Configure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			L.Info("hello")
+			if tt.want == "" {
+				if buf.Len() != 0 {
+					t.Errorf("output = %q, want nothing", buf.String())
+				}
+			} else if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("output = %q, want it to contain %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFollowsL(t *testing.T) {
+	captureL(t)
+	if err := Configure(&config.Log{Level: "debug", Format: config.LogFormatLogfmt}); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+
+	log, err := New(&config.Log{Level: "error"}, &config.Log{Level: "debug"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	log.Warn("ignored")
+	log.Error("failed")
+	if out := buf.String(); strings.Contains(out, "ignored") || !strings.Contains(out, `level="error" msg="failed"`) {
+		t.Errorf("output = %q, want only the error, formatted as logfmt", out)
+	}
+
+	// Without a level, the vhost logger takes the one of the global settings, which may
+	// not be applied to L yet.
+	log, err = New(&config.Log{Format: config.LogFormatJSON}, &config.Log{Level: "warn"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if log.GetLevel() != logrus.WarnLevel {
+		t.Errorf("level = %s, want warning", log.GetLevel())
+	}
+}
+
+func TestRequestLogContext(t *testing.T) {
+	buf := captureL(t)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(WithVhost("api.example.com", nil, nil))
+	r.With(WithEndpoint("/users/{id}")).Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).WithField("target", "http://users").Error("boom")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Unmarshal(%q) error = %v", buf.String(), err)
+	}
+	want := logrus.Fields{
+		FieldRequestID: "req-1",
+		FieldVhost:     "api.example.com",
+		FieldEndpoint:  "/users/{id}",
+		"target":       "http://users",
+		"msg":          "boom",
+		"level":        "error",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("entry[%q] = %v, want %v", key, entry[key], value)
+		}
+	}
+}
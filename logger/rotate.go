@@ -0,0 +1,155 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotationTimeFormat is the suffix format of the rotated log files.
+const rotationTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is rotated once it grows over maxSize bytes, or once
+// it is older than interval. Rotated files are renamed with a timestamp suffix, and only
+// the maxBackups most recent ones are kept. Zero values disable the respective rule.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		// Requests that outlive a configuration reload still get logged.
+		return appendFile(f.path, p)
+	}
+	if f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			L.Error("Error rotating log file:", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) due(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.openedAt) >= f.interval
+}
+
+// rotate renames the current file and starts a new one.
+func (f *rotatingFile) rotate() error {
+	_ = f.file.Close()
+
+	// The file is reopened even if it could not be renamed, so that logging goes on.
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().Format(rotationTimeFormat))
+	if err := f.open(); err != nil {
+		f.file = nil
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond maxBackups. Only the files named like
+// rotate names them are considered, so that other files, such as the ones compressed by
+// logrotate, are left alone.
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if _, err := time.Parse(rotationTimeFormat, suffix); err == nil {
+			backups = append(backups, entry.Name())
+		}
+	}
+	if len(backups) <= f.maxBackups {
+		return
+	}
+	// The timestamp suffixes sort chronologically.
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		_ = os.Remove(filepath.Join(filepath.Dir(f.path), backup))
+	}
+}
+
+// appendFile appends p to the file at path, without keeping it open.
+func appendFile(path string, p []byte) (int, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.Write(p)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Close closes the file. Later writes open it again, for each of them.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,103 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSize     int64
+		interval    time.Duration
+		maxBackups  int
+		writes      int
+		wantBackups int
+	}{
+		{name: "size", maxSize: 10, writes: 4, wantBackups: 3},
+		{name: "max backups", maxSize: 10, maxBackups: 2, writes: 5, wantBackups: 2},
+		{name: "interval", interval: time.Nanosecond, writes: 3, wantBackups: 2},
+		{name: "no rotation", writes: 4, wantBackups: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			f, err := openRotatingFile(path, tt.maxSize, tt.interval, tt.maxBackups)
+			if err != nil {
+				t.Fatalf("openRotatingFile() error = %v", err)
+			}
+			defer f.Close()
+
+			for i := 0; i < tt.writes; i++ {
+				if _, err := f.Write([]byte("12345678\n")); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				// Rotated files are named after the time they were rotated at.
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			backups, _ := filepath.Glob(path + ".*")
+			if len(backups) != tt.wantBackups {
+				t.Errorf("got %d rotated files, want %d", len(backups), tt.wantBackups)
+			}
+			current, _ := os.ReadFile(path)
+			if tt.wantBackups > 0 && string(current) != "12345678\n" {
+				t.Errorf("current file = %q, want the last write only", current)
+			}
+		})
+	}
+}
+
+func TestRotatingFileKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	others := []string{"access.log.gz", "access.log.bak", "access.log.20240101T000000.000.gz", "access.log.1"}
+	for _, name := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := openRotatingFile(path, 10, 0, 1)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("12345678\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+	// Only the last rotated file is kept, along with the current one and the others.
+	if entries, _ := os.ReadDir(dir); len(entries) != len(others)+2 {
+		t.Errorf("got %d files, want %d", len(entries), len(others)+2)
+	}
+}
+
+func TestRotatingFileWriteAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	_, _ = f.Write([]byte("before\n"))
+	_ = f.Close()
+
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatalf("Write() after Close error = %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(content), "before\nafter\n") {
+		t.Errorf("file = %q, want both writes", content)
+	}
+}
@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// namespace prefixes the names of all the metrics of the gateway.
+const namespace = "gateh8"
+
+// Directions of the messages relayed over WebSocket sessions.
+const (
+	Upstream   = "upstream"   // From the client to the backend.
+	Downstream = "downstream" // From the backend to the client.
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests served, by API consumer.",
+	}, []string{"vhost", "endpoint", "method", "code", "consumer"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent serving HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"vhost", "endpoint", "method", "code"})
+
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_response_size_bytes",
+		Help:      "Size of the HTTP response bodies.",
+		Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"vhost", "endpoint", "method", "code"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until the response headers of the upstream targets were received.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "target"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Number of failed upstream requests, by type: timeout, error or 5xx.",
+	}, []string{"backend", "target", "type"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Number of upstream requests retried.",
+	}, []string{"backend"})
+
+	webSocketMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_messages_total",
+		Help:      "Number of WebSocket messages relayed.",
+	}, []string{"endpoint", "direction"})
+
+	webSocketBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_bytes_total",
+		Help:      "Size of the WebSocket messages relayed.",
+	}, []string{"endpoint", "direction"})
+)
+
+// registry holds the metrics recorded while serving requests. They outlive configuration reloads.
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, requestDuration, responseSize,
+		upstreamDuration, upstreamErrors, upstreamRetries,
+		webSocketMessages, webSocketBytes,
+	)
+}
+
+// Handler returns the handler exposing the metrics in the Prometheus format, along with
+// the ones of the given collectors, which are read when the metrics are scraped.
+func Handler(extra ...prometheus.Collector) http.Handler {
+	gatherers := prometheus.Gatherers{registry}
+	if len(extra) > 0 {
+		local := prometheus.NewRegistry()
+		local.MustRegister(extra...)
+		gatherers = append(gatherers, local)
+	}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
+
+// requestRecord holds the labels of a request that are only known to the handlers.
+type requestRecord struct {
+	consumer string
+}
+
+type contextKey struct {
+	name string
+}
+
+// requestRecordKey is the context key of the requestRecord of a request.
+var requestRecordKey = &contextKey{"requestRecord"}
+
+// RecordConsumer records the API consumer that sent the request, in the request metrics.
+// Consumers are configured, so that the number of series stays bounded.
+func RecordConsumer(ctx context.Context, consumer string) {
+	if rec, ok := ctx.Value(requestRecordKey).(*requestRecord); ok {
+		rec.consumer = consumer
+	}
+}
+
+// Middleware records the requests served by a vhost. Requests are labeled with the
+// route pattern of the endpoint that served them, rather than with their path.
+func Middleware(vhost string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rec := &requestRecord{}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), requestRecordKey, rec)))
+
+			endpoint := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				endpoint = rctx.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 && ww.BytesWritten() == 0 && r.Header.Get("Upgrade") != "" {
+				status = http.StatusSwitchingProtocols // The connection was hijacked.
+			}
+
+			labels := prometheus.Labels{
+				"vhost":    vhost,
+				"endpoint": endpoint,
+				"method":   r.Method,
+				"code":     StatusClass(status),
+			}
+			requestDuration.With(labels).Observe(time.Since(start).Seconds())
+			responseSize.With(labels).Observe(float64(ww.BytesWritten()))
+			labels["consumer"] = rec.consumer
+			requests.With(labels).Inc()
+		})
+	}
+}
+
+// StatusClass returns the class of a status code, such as "2xx". Responses that were
+// never written count as 200 responses, like net/http sends them.
+func StatusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// ObserveUpstream records the outcome of a request sent to an upstream target.
+func ObserveUpstream(backend, target string, duration time.Duration, resp *http.Response, err error) {
+	upstreamDuration.WithLabelValues(backend, target).Observe(duration.Seconds())
+
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		upstreamErrors.WithLabelValues(backend, target, "timeout").Inc()
+	case err != nil:
+		upstreamErrors.WithLabelValues(backend, target, "error").Inc()
+	case resp.StatusCode >= http.StatusInternalServerError:
+		upstreamErrors.WithLabelValues(backend, target, "5xx").Inc()
+	}
+}
+
+// ObserveRetry records a request retried on another attempt.
+func ObserveRetry(backend string) {
+	upstreamRetries.WithLabelValues(backend).Inc()
+}
+
+// WebSocketCounters returns the counters of the messages relayed by an endpoint in a direction,
+// and of their size.
+func WebSocketCounters(endpoint, direction string) (messages, bytes prometheus.Counter) {
+	return webSocketMessages.WithLabelValues(endpoint, direction), webSocketBytes.WithLabelValues(endpoint, direction)
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{0, "2xx"},
+		{101, "1xx"},
+		{204, "2xx"},
+		{302, "3xx"},
+		{404, "4xx"},
+		{503, "5xx"},
+	}
+	for _, tt := range tests {
+		if got := StatusClass(tt.status); got != tt.want {
+			t.Errorf("StatusClass(%d) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware("api.example.com"))
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	r.Get("/orders", func(w http.ResponseWriter, r *http.Request) {
+		RecordConsumer(r.Context(), "mobile-app")
+	})
+
+	for _, id := range []string{"1", "2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/"+id, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders", nil))
+
+	got := testutil.ToFloat64(requests.WithLabelValues("api.example.com", "/users/{id}", http.MethodGet, "4xx", ""))
+	if got != 2 {
+		t.Errorf("requests = %v, want 2", got)
+	}
+	got = testutil.ToFloat64(requests.WithLabelValues("api.example.com", "/orders", http.MethodGet, "2xx", "mobile-app"))
+	if got != 1 {
+		t.Errorf("requests of the consumer = %v, want 1", got)
+	}
+	if n := testutil.CollectAndCount(responseSize, "gateh8_http_response_size_bytes"); n != 2 {
+		t.Errorf("response size series = %d, want 2", n)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestObserveUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		resp     *http.Response
+		err      error
+		wantType string
+	}{
+		{name: "timeout", err: timeoutError{}, wantType: "timeout"},
+		{name: "error", err: errors.New("connection refused"), wantType: "error"},
+		{name: "5xx", resp: &http.Response{StatusCode: http.StatusBadGateway}, wantType: "5xx"},
+		{name: "success", resp: &http.Response{StatusCode: http.StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ObserveUpstream("backend-"+tt.name, "http://a", time.Millisecond, tt.resp, tt.err)
+
+			for _, errorType := range []string{"timeout", "error", "5xx"} {
+				want := 0.0
+				if errorType == tt.wantType {
+					want = 1
+				}
+				if got := testutil.ToFloat64(upstreamErrors.WithLabelValues("backend-"+tt.name, "http://a", errorType)); got != want {
+					t.Errorf("%s errors = %v, want %v", errorType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveRetry("handler-test")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), `gateh8_upstream_retries_total{backend="handler-test"} 1`) {
+		t.Errorf("metrics do not contain the retries counter:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/tracing"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultForwardAuthTimeout    = 5 * time.Second
+	defaultForwardAuthMaxEntries = 10000
+	// maxForwardAuthBody bounds the body of the denials relayed to the clients.
+	maxForwardAuthBody = 64 << 10
+)
+
+// forwardingHeaders are sent to the forward authentication service even when its request
+// headers are restricted, so that it knows where the request comes from.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "X-Request-Id"}
+
+// ForwardAuth authorizes the requests with an external service, and caches its decisions
+// when configured to.
+type ForwardAuth struct {
+	cfg     *config.ForwardAuth
+	client  *http.Client
+	timeout time.Duration
+	cache   *decisionCache
+}
+
+// NewForwardAuth creates the forward authentication of the configuration, reaching the
+// service with the HTTP client.
+func NewForwardAuth(cfg *config.ForwardAuth, httpClient *http.Client) *ForwardAuth {
+	f := &ForwardAuth{
+		cfg:     cfg,
+		client:  httpClient,
+		timeout: cfg.Timeout.Or(defaultForwardAuthTimeout),
+	}
+	if cfg.Cache != nil {
+		maxEntries := cfg.Cache.MaxEntries
+		if maxEntries == 0 {
+			maxEntries = defaultForwardAuthMaxEntries
+		}
+		f.cache = newDecisionCache(time.Duration(cfg.Cache.TTL), maxEntries)
+	}
+	return f
+}
+
+// decision is the outcome of a subrequest to the forward authentication service. The
+// headers are the configured response headers of the request let through, or the
+// end-to-end headers of the response returned to the client otherwise.
+type decision struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (d *decision) allowed() bool {
+	return d.status >= 200 && d.status < 300
+}
+
+func (d *decision) cacheable() bool {
+	return d.allowed() || d.status == http.StatusUnauthorized || d.status == http.StatusForbidden
+}
+
+// Middleware lets the requests authorized by the service through. The requests it denies
+// get its response, and the ones it cannot decide on are rejected with a 503 Service
+// Unavailable, or let through if the forward authentication fails open.
+func (f *ForwardAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+
+		var key string
+		if f.cache != nil {
+			key = f.cacheKey(r)
+		}
+		d, ok := f.cache.get(key)
+		if !ok {
+			var err error
+			if d, err = f.authorize(r); err != nil {
+				if f.cfg.FailOpen {
+					log.WithError(err).Warn("Forward authentication failed, letting the request through")
+					// Without a decision, the headers of the service cannot be trusted from the client either.
+					for _, name := range f.cfg.ResponseHeaders {
+						r.Header.Del(name)
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+				log.WithError(err).Error("Forward authentication failed")
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if d.cacheable() {
+				f.cache.set(key, d)
+			}
+		}
+
+		if !d.allowed() {
+			log.WithField("status", d.status).Info("Forward authentication denied the request")
+			for name, values := range d.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(d.status)
+			_, _ = w.Write(d.body)
+			return
+		}
+
+		// The headers set by the service replace the ones of the client, which cannot forge them.
+		for _, name := range f.cfg.ResponseHeaders {
+			r.Header.Del(name)
+			for _, value := range d.header.Values(name) {
+				r.Header.Add(name, value)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize sends the subrequest asking the service whether the request is authorized.
+// It carries the method, URI and headers of the request, but not its body.
+func (f *ForwardAuth) authorize(r *http.Request) (*decision, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, f.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	copyRequestHeaders(req, r)
+	if len(f.cfg.RequestHeaders) > 0 {
+		header := make(http.Header)
+		for _, name := range append(forwardingHeaders, f.cfg.RequestHeaders...) {
+			if values := req.Header.Values(name); len(values) > 0 {
+				header[textproto.CanonicalMIMEHeaderKey(name)] = values
+			}
+		}
+		req.Header = header
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	ctx, span := tracing.StartUpstream(ctx, "forwardAuth", req.Method, req.URL.String(), req.Header)
+	resp, err := f.client.Do(req.WithContext(ctx))
+	tracing.EndUpstream(span, statusCode(resp), err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	d := &decision{status: resp.StatusCode, header: make(http.Header)}
+	if d.allowed() {
+		for _, name := range f.cfg.ResponseHeaders {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				d.header[textproto.CanonicalMIMEHeaderKey(name)] = values
+			}
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxForwardAuthBody))
+		return d, nil
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Del("Content-Length")
+	d.header = resp.Header
+	if d.body, err = io.ReadAll(io.LimitReader(resp.Body, maxForwardAuthBody)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// cacheKey returns the key of the request's decision in the cache, made of the configured
+// parts of the request.
+func (f *ForwardAuth) cacheKey(r *http.Request) string {
+	var b strings.Builder
+	for _, part := range f.cfg.Cache.Key {
+		switch {
+		case part == config.ForwardAuthKeyMethod:
+			b.WriteString(r.Method)
+		case part == config.ForwardAuthKeyHost:
+			b.WriteString(r.Host)
+		case part == config.ForwardAuthKeyPath:
+			b.WriteString(r.URL.EscapedPath())
+		case part == config.ForwardAuthKeyQuery:
+			b.WriteString(r.URL.RawQuery)
+		case strings.HasPrefix(part, "header."):
+			b.WriteString(strings.Join(r.Header.Values(strings.TrimPrefix(part, "header.")), ", "))
+		case strings.HasPrefix(part, "cookie."):
+			if cookie, err := r.Cookie(strings.TrimPrefix(part, "cookie.")); err == nil {
+				b.WriteString(cookie.Value)
+			}
+		}
+		// The parts are separated by a byte no part can contain, so that they cannot be confused.
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// decisionCache caches the decisions of a forward authentication service until they expire.
+// A nil cache caches nothing.
+type decisionCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]cachedDecision
+}
+
+type cachedDecision struct {
+	*decision
+	expires time.Time
+}
+
+func newDecisionCache(ttl time.Duration, maxEntries int) *decisionCache {
+	return &decisionCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]cachedDecision)}
+}
+
+func (c *decisionCache) get(key string) (*decision, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.decision, true
+}
+
+// set caches the decision. When the cache is full, the expired decisions are evicted, or
+// an arbitrary one if none expired.
+func (c *decisionCache) set(key string, d *decision) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedDecision{decision: d, expires: now.Add(c.ttl)}
+}
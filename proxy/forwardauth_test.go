@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receivedHeaders records the headers of the last subrequest received by the service.
+// The service may still be handling a subrequest the client gave up on.
+type receivedHeaders struct {
+	mu     sync.Mutex
+	header http.Header
+}
+
+func (h *receivedHeaders) set(header http.Header) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header = header
+}
+
+func (h *receivedHeaders) Get(key string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.header.Get(key)
+}
+
+// newAuthServer starts a forward authentication service allowing the requests with the
+// "Bearer good" authorization, and counting the subrequests it receives.
+func newAuthServer(t *testing.T, calls *atomic.Int32, received *receivedHeaders) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if received != nil {
+			received.set(r.Header.Clone())
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Ignored", "1")
+		case "Bearer down":
+			w.WriteHeader(http.StatusBadGateway)
+		case "Bearer slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("denied"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serveForwardAuth serves a request with the authorization through the forward
+// authentication, and returns the response along with the headers the backend received.
+func serveForwardAuth(f *ForwardAuth, authorization string, headers map[string]string) (*httptest.ResponseRecorder, http.Header) {
+	var upstream http.Header
+	handler := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/orders?id=1", nil)
+	req.Header.Set("Authorization", authorization)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, upstream
+}
+
+func TestForwardAuth(t *testing.T) {
+	var (
+		calls    atomic.Int32
+		received receivedHeaders
+	)
+	server := newAuthServer(t, &calls, &received)
+
+	tests := []struct {
+		name          string
+		cfg           config.ForwardAuth
+		authorization string
+		wantStatus    int
+		wantUpstream  bool
+	}{
+		{name: "allowed", authorization: "Bearer good", wantStatus: http.StatusOK, wantUpstream: true},
+		{name: "denied", authorization: "Bearer bad", wantStatus: http.StatusUnauthorized},
+		{name: "service error", authorization: "Bearer down", wantStatus: http.StatusBadGateway},
+		{name: "timeout", cfg: config.ForwardAuth{Timeout: config.Duration(50 * time.Millisecond)}, authorization: "Bearer slow", wantStatus: http.StatusServiceUnavailable},
+		{name: "timeout failing open", cfg: config.ForwardAuth{Timeout: config.Duration(50 * time.Millisecond), FailOpen: true}, authorization: "Bearer slow", wantStatus: http.StatusOK, wantUpstream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.URL = server.URL
+			cfg.ResponseHeaders = []string{"X-User"}
+			f := NewForwardAuth(&cfg, http.DefaultClient)
+
+			rec, upstream := serveForwardAuth(f, tt.authorization, map[string]string{"X-User": "mallory"})
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if (upstream != nil) != tt.wantUpstream {
+				t.Fatalf("proxied = %v, want %v", upstream != nil, tt.wantUpstream)
+			}
+			if upstream != nil {
+				// Without a decision of the service, the header of the client is not trusted either.
+				want := "alice"
+				if cfg.FailOpen {
+					want = ""
+				}
+				if got := upstream.Get("X-User"); got != want {
+					t.Errorf("X-User = %q, want %q", got, want)
+				}
+				if got := upstream.Get("X-Ignored"); got != "" {
+					t.Errorf("X-Ignored = %q, want it not copied", got)
+				}
+			}
+		})
+	}
+
+	if got := received.Get("X-Forwarded-Method"); got != http.MethodPost {
+		t.Errorf("X-Forwarded-Method = %q, want %q", got, http.MethodPost)
+	}
+	if got := received.Get("X-Forwarded-Uri"); got != "/orders?id=1" {
+		t.Errorf("X-Forwarded-Uri = %q, want %q", got, "/orders?id=1")
+	}
+}
+
+func TestForwardAuthDenial(t *testing.T) {
+	var calls atomic.Int32
+	server := newAuthServer(t, &calls, nil)
+	f := NewForwardAuth(&config.ForwardAuth{URL: server.URL}, http.DefaultClient)
+
+	rec, _ := serveForwardAuth(f, "Bearer bad", nil)
+	if got := rec.Header().Get("WWW-Authenticate"); got != `Bearer realm="api"` {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, `Bearer realm="api"`)
+	}
+	if got := rec.Body.String(); got != "denied" {
+		t.Errorf("body = %q, want %q", got, "denied")
+	}
+}
+
+func TestForwardAuthRequestHeaders(t *testing.T) {
+	var (
+		calls    atomic.Int32
+		received receivedHeaders
+	)
+	server := newAuthServer(t, &calls, &received)
+	f := NewForwardAuth(&config.ForwardAuth{URL: server.URL, RequestHeaders: []string{"authorization"}}, http.DefaultClient)
+
+	serveForwardAuth(f, "Bearer good", map[string]string{"Cookie": "session=1"})
+	if got := received.Get("Authorization"); got != "Bearer good" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer good")
+	}
+	if got := received.Get("Cookie"); got != "" {
+		t.Errorf("Cookie = %q, want it not sent", got)
+	}
+	if got := received.Get("X-Forwarded-For"); got == "" {
+		t.Error("X-Forwarded-For not sent")
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	var calls atomic.Int32
+	server := newAuthServer(t, &calls, nil)
+	f := NewForwardAuth(&config.ForwardAuth{
+		URL:             server.URL,
+		ResponseHeaders: []string{"X-User"},
+		Cache: &config.ForwardAuthCache{
+			Key: []string{"method", "path", "header.Authorization"},
+			TTL: config.Duration(time.Minute),
+		},
+	}, http.DefaultClient)
+
+	tests := []struct {
+		authorization string
+		wantStatus    int
+		wantCalls     int32
+	}{
+		{authorization: "Bearer good", wantStatus: http.StatusOK, wantCalls: 1},
+		{authorization: "Bearer good", wantStatus: http.StatusOK, wantCalls: 1},
+		{authorization: "Bearer bad", wantStatus: http.StatusUnauthorized, wantCalls: 2},
+		{authorization: "Bearer bad", wantStatus: http.StatusUnauthorized, wantCalls: 2},
+		// Failures of the service are not cached.
+		{authorization: "Bearer down", wantStatus: http.StatusBadGateway, wantCalls: 3},
+		{authorization: "Bearer down", wantStatus: http.StatusBadGateway, wantCalls: 4},
+	}
+	for _, tt := range tests {
+		rec, upstream := serveForwardAuth(f, tt.authorization, nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.authorization, rec.Code, tt.wantStatus)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("%s: calls = %d, want %d", tt.authorization, got, tt.wantCalls)
+		}
+		if upstream != nil && upstream.Get("X-User") != "alice" {
+			t.Errorf("%s: X-User = %q, want %q", tt.authorization, upstream.Get("X-User"), "alice")
+		}
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	c := newDecisionCache(time.Minute, 2)
+	allowed := &decision{status: http.StatusOK}
+	c.set("a", allowed)
+	c.set("b", allowed)
+	c.set("c", allowed)
+	if got := len(c.entries); got != 2 {
+		t.Errorf("entries = %d, want 2", got)
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("get(c) missed the latest decision")
+	}
+
+	expired := newDecisionCache(-time.Second, 10)
+	expired.set("a", allowed)
+	if _, ok := expired.get("a"); ok {
+		t.Error("get(a) returned an expired decision")
+	}
+}
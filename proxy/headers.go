@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/yarlson/GateH8/config"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers defined by RFC 7230, section 6.1. They apply to a
+// single connection and must not be forwarded by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+type contextKey struct {
+	name string
+}
+
+// peerKey is the context key of the peer information stored by RealIP.
+var peerKey = &contextKey{"peer"}
+
+// peer describes the connection a request was received on.
+type peer struct {
+	addr    string
+	trusted bool
+}
+
+// RealIP is a middleware that sets the request's RemoteAddr to the IP of the client.
+// X-Forwarded-For and X-Real-IP are only honoured when the request comes from one of the
+// trusted proxies, in which case the client is the right-most untrusted address of the chain.
+// The address of the immediate peer is kept in the request context for the forwarding headers.
+func RealIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := peer{addr: remoteIP(r.RemoteAddr)}
+			p.trusted = isTrusted(p.addr, trustedProxies)
+
+			if p.trusted {
+				if client := forwardedClient(r.Header, trustedProxies); client != "" {
+					r.RemoteAddr = client
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey, p)))
+		})
+	}
+}
+
+// forwardedClient returns the client IP announced by the forwarding headers of a trusted proxy.
+func forwardedClient(h http.Header, trustedProxies []*net.IPNet) string {
+	var chain []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); net.ParseIP(addr) != nil {
+				chain = append(chain, addr)
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrusted(chain[i], trustedProxies) || i == 0 {
+			return chain[i]
+		}
+	}
+
+	if realIP := strings.TrimSpace(h.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ""
+}
+
+func isTrusted(addr string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP part of a remote address.
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// copyRequestHeaders copies the end-to-end headers of the incoming request to the
+// upstream request, and sets the X-Forwarded-* and Forwarded (RFC 7239) headers.
+// Forwarding headers of the incoming request are only kept if it came from a trusted proxy.
+func copyRequestHeaders(req, r *http.Request) {
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+
+	// "Te: trailers" is the only TE value that is end-to-end: it announces support for trailers.
+	for _, te := range r.Header.Values("Te") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			req.Header.Set("Te", "trailers")
+		}
+	}
+
+	req.Header.Set("User-Agent", r.Header.Get("User-Agent")+" via GateH8")
+
+	// The request ID lets the backend logs be correlated with the gateway's.
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		req.Header.Set(middleware.RequestIDHeader, id)
+	}
+
+	p, ok := r.Context().Value(peerKey).(peer)
+	if !ok {
+		p = peer{addr: remoteIP(r.RemoteAddr)}
+	}
+	if !p.trusted {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP", "Forwarded"} {
+			req.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+p.addr)
+	} else {
+		req.Header.Set("X-Forwarded-For", p.addr)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	forwarded := "for=" + forwardedNode(p.addr) + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	req.Header.Set("Forwarded", forwarded)
+}
+
+// forwardedNode formats an IP as a Forwarded node, quoting and bracketing IPv6 addresses.
+func forwardedNode(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return `"[` + addr + `]"`
+	}
+	return quoteForwarded(addr)
+}
+
+// quoteForwarded quotes a Forwarded parameter value when it is not a valid token.
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	return c < 127 && c > 32 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
+
+// ParseTrustedProxies parses the trusted proxies of the configuration.
+func ParseTrustedProxies(cfg *config.Config) []*net.IPNet {
+	networks, _ := config.ParseNetworks(cfg.TrustedProxies)
+	return networks
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCopyRequestHeaders(t *testing.T) {
+	trusted, _ := config.ParseNetworks([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       "end-to-end and hop-by-hop",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"Authorization": "Bearer token",
+				"Cookie":        "a=b",
+				"Connection":    "close, X-Hop",
+				"X-Hop":         "1",
+				"Keep-Alive":    "timeout=5",
+				"User-Agent":    "curl",
+			},
+			want: map[string]string{
+				"Authorization":     "Bearer token",
+				"Cookie":            "a=b",
+				"Connection":        "",
+				"X-Hop":             "",
+				"Keep-Alive":        "",
+				"User-Agent":        "curl via GateH8",
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "example.com",
+				"Forwarded":         "for=192.0.2.1;host=example.com;proto=http",
+			},
+		},
+		{
+			name:       "untrusted forwarding headers",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "192.0.2.1",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=192.0.2.1;host=example.com;proto=http",
+			},
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.2:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "198.51.100.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"Forwarded":         "for=198.51.100.7",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.7, 10.0.0.2",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"Forwarded":         "for=198.51.100.7, for=10.0.0.2;host=example.com;proto=http",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			var req *http.Request
+			RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req, _ = createRequest(r, "http://backend/")
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			for name, want := range tt.want {
+				if got := req.Header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, _ := config.ParseNetworks([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{name: "untrusted peer", remoteAddr: "192.0.2.1:1234", xff: "1.2.3.4", want: "192.0.2.1:1234"},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", xff: "1.2.3.4", want: "1.2.3.4"},
+		{name: "trusted chain", remoteAddr: "10.0.0.1:1234", xff: "6.6.6.6, 1.2.3.4, 10.0.0.9", want: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", tt.xff)
+
+			var got string
+			RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
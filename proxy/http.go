@@ -1,70 +1,221 @@
 package proxy
 
 import (
+	"bytes"
+	"errors"
 	"github.com/yarlson/GateH8/client"
 	"github.com/yarlson/GateH8/config"
 	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/metrics"
+	"github.com/yarlson/GateH8/retry"
+	"github.com/yarlson/GateH8/tracing"
+	"github.com/yarlson/GateH8/upstream"
 	"io"
 	"net/http"
-	"strings"
 	"time"
 )
 
-func CreateHttpProxyHandler(backend *config.Backend, httpClient *http.Client) http.HandlerFunc {
+func CreateHttpProxyHandler(backend *config.Backend, pool *upstream.Pool, policy *retry.Policy, httpClient *http.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		req, err := setupRequest(r, backend)
-		if err != nil {
-			logger.L.Error("Error setting up request:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		log := logger.FromContext(r.Context())
+
+		// Buffer the request body when the request may be retried, so that it can be replayed.
+		policy.Track()
+		attempts := policy.Attempts(r)
+		if attempts > 1 {
+			replayable, err := bufferBody(r, policy.MaxBodySize())
+			if err != nil {
+				log.WithError(err).Error("Error reading request body")
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if !replayable {
+				attempts = 1
+			}
 		}
 
 		proxyClient := client.NewHttpProxyClient(httpClient)
-		resp, err := proxyClient.Execute(req, time.Duration(backend.Timeout)*time.Second)
-		if err != nil {
-			logger.L.Error("Error executing proxy request:", err)
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
-			return
+		timeout := time.Duration(backend.Timeout) * time.Second
+
+		var (
+			target *upstream.Target
+			resp   *http.Response
+		)
+		for attempt := 1; ; attempt++ {
+			var err error
+			target, err = pool.Next(r)
+			if err != nil {
+				log.WithError(err).Error("Error selecting upstream target")
+				writeUnavailable(w, backend, err)
+				return
+			}
+			target.Acquire()
+
+			req, err := setupRequest(r, backend, target)
+			if err != nil {
+				target.Report(true) // Not the target's fault, release its half-open slot if any.
+				target.Release()
+				log.WithError(err).Error("Error setting up request")
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			ctx, span := tracing.StartUpstream(req.Context(), pool.Name(), req.Method, req.URL.String(), req.Header)
+			start := time.Now()
+			resp, err = proxyClient.Execute(req.WithContext(ctx), timeout)
+			elapsed := time.Since(start)
+			metrics.ObserveUpstream(pool.Name(), target.URL, elapsed, resp, err)
+			logger.RecordUpstream(r.Context(), req.URL.Host, elapsed)
+			tracing.EndUpstream(span, statusCode(resp), err)
+			target.Report(err == nil && resp.StatusCode < http.StatusInternalServerError)
+
+			if attempt < attempts && policy.Retryable(resp, err) && policy.Wait(r.Context(), attempt) {
+				log.WithField("target", target.URL).Warnf("Retrying request after attempt %d of %d failed", attempt, attempts)
+				metrics.ObserveRetry(pool.Name())
+				if resp != nil {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+				}
+				target.Release()
+				continue
+			}
+
+			if err != nil {
+				target.Release()
+				log.WithError(err).WithField("target", target.URL).Error("Error executing proxy request")
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			break
 		}
+		defer target.Release()
+		defer resp.Body.Close()
+
+		relayResponse(w, r, resp, time.Duration(backend.FlushInterval))
+	}
+}
+
+// statusCode returns the status of the response, or 0 when there is none.
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// bufferBody reads the request body into memory so that it can be sent again on retries.
+// Bodies larger than maxSize are left streaming and reported as not replayable.
+func bufferBody(r *http.Request, maxSize int64) (bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(body)) > maxSize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return false, nil
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return true, nil
+}
 
-		relayResponse(w, resp)
+// writeUnavailable answers a request for which no upstream target could be selected.
+// Requests rejected by open circuits get the fail-fast response of the circuit breaker, if configured.
+func writeUnavailable(w http.ResponseWriter, backend *config.Backend, err error) {
+	if errors.Is(err, upstream.ErrCircuitOpen) && backend.CircuitBreaker != nil && backend.CircuitBreaker.Response != nil {
+		writeFailFast(w, backend.CircuitBreaker.Response)
+		return
+	}
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// writeFailFast writes a response configured to be returned by the gateway itself.
+func writeFailFast(w http.ResponseWriter, resp *config.FailFastResponse) {
+	for key, value := range resp.Headers {
+		w.Header().Set(key, value)
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
 	}
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, resp.Body)
 }
 
-func setupRequest(r *http.Request, backend *config.Backend) (*http.Request, error) {
-	processedURL := processURL(backend, r.URL.Path)
+func setupRequest(r *http.Request, backend *config.Backend, target *upstream.Target) (*http.Request, error) {
+	processedURL := processURL(target.URL, r, backend.AppendsQuery())
 	return createRequest(r, processedURL)
 }
 
 // relayResponse takes the backend response and relays it back to the original caller.
-func relayResponse(w http.ResponseWriter, resp *http.Response) {
-	// Business Logic: Relay all headers and the body from the backend response to the original caller
+// The body is streamed as it arrives, and trailers are relayed once it is complete.
+func relayResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, flushInterval time.Duration) {
+	// Business Logic: Relay all end-to-end headers and the body from the backend response to the original caller
+	removeHopHeaders(resp.Header)
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
-	body, _ := io.ReadAll(resp.Body)
+
+	// Announce the trailers, so that they can be sent after the body.
+	announced := make(map[string]bool, len(resp.Trailer))
+	for key := range resp.Trailer {
+		announced[key] = true
+		w.Header().Add("Trailer", key)
+	}
+
 	w.WriteHeader(resp.StatusCode)
-	_, _ = w.Write(body)
-}
 
-func processURL(backend *config.Backend, path string) string {
-	if strings.Contains(backend.URL, "${path}") {
-		return backend.GetProcessedURL(path)
+	readErr, writeErr := streamBody(w, resp.Body, flushIntervalFor(resp, flushInterval))
+	if writeErr != nil {
+		logger.FromContext(r.Context()).WithError(writeErr).Warn("Error writing response to client")
+		return
+	}
+	if readErr != nil {
+		// The status line is already sent: abort the connection, so that the client
+		// sees a truncated response rather than a complete-looking one.
+		logger.FromContext(r.Context()).WithError(readErr).Error("Error reading response from backend")
+		panic(http.ErrAbortHandler)
+	}
+
+	// Trailers are only known once the body has been read entirely.
+	for key, values := range resp.Trailer {
+		if !announced[key] {
+			key = http.TrailerPrefix + key
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
 	}
-	return backend.URL
 }
 
 func createRequest(r *http.Request, url string) (*http.Request, error) {
-	req, err := http.NewRequest(r.Method, url, r.Body)
+	// A buffered body is replayed from the start on every attempt.
+	body := r.Body
+	if r.GetBody != nil {
+		var err error
+		if body, err = r.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, body)
 	if err != nil {
 		return nil, err
 	}
-
-	originalUserAgent := r.Header.Get("User-Agent")
-	modifiedUserAgent := originalUserAgent + " via GateH8"
-	req.Header.Set("User-Agent", modifiedUserAgent)
+	req.ContentLength = r.ContentLength
+	copyRequestHeaders(req, r)
 
 	return req, nil
 }
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Maintenance keeps track of the vhosts in maintenance mode. It is shared by every
+// configuration, so that the mode survives reloads.
+type Maintenance struct {
+	mu     sync.RWMutex
+	vhosts map[string]bool
+}
+
+// NewMaintenance creates a Maintenance with no vhost in maintenance mode.
+func NewMaintenance() *Maintenance {
+	return &Maintenance{vhosts: make(map[string]bool)}
+}
+
+// Set puts the vhost in maintenance mode, or takes it out of it.
+func (m *Maintenance) Set(vhost string, enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if enabled {
+		m.vhosts[vhost] = true
+	} else {
+		delete(m.vhosts, vhost)
+	}
+}
+
+// Enabled reports whether the vhost is in maintenance mode.
+func (m *Maintenance) Enabled(vhost string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.vhosts[vhost]
+}
+
+// Vhosts returns the vhosts in maintenance mode, sorted by name.
+func (m *Maintenance) Vhosts() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vhosts := make([]string, 0, len(m.vhosts))
+	for vhost := range m.vhosts {
+		vhosts = append(vhosts, vhost)
+	}
+	sort.Strings(vhosts)
+	return vhosts
+}
+
+// Middleware answers the requests of the vhost with resp while it is in maintenance mode,
+// or with a 503 Service Unavailable if resp is nil.
+func (m *Maintenance) Middleware(vhost string, resp *config.FailFastResponse) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.Enabled(vhost) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if resp != nil {
+				writeFailFast(w, resp)
+				return
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamBufferSize is the size of the buffer used to copy response bodies.
+const streamBufferSize = 32 * 1024
+
+// flushIntervalFor returns the flush interval to use for a response: negative to flush
+// after every write, zero to only flush once the body is complete. Server-Sent Events
+// are always flushed immediately, whatever the configured interval.
+func flushIntervalFor(resp *http.Response, configured time.Duration) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return -1
+	}
+	return configured
+}
+
+// streamBody copies the response body to the client as it arrives, flushing it according
+// to the flush interval. Read errors are reported separately from write errors, as only
+// the former are the backend's fault.
+func streamBody(w http.ResponseWriter, body io.Reader, flushInterval time.Duration) (readErr, writeErr error) {
+	dst := io.Writer(w)
+	if flushInterval != 0 {
+		fw := &flushWriter{w: w, rc: http.NewResponseController(w), interval: flushInterval}
+		defer fw.stop()
+		dst = fw
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+// flushWriter flushes the response after every write when its interval is negative, or
+// at most once per interval otherwise.
+type flushWriter struct {
+	w        io.Writer
+	rc       *http.ResponseController
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if fw.interval < 0 {
+		return n, fw.flush()
+	}
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.pending {
+		_ = fw.flush()
+		fw.pending = false
+	}
+}
+
+func (fw *flushWriter) flush() error {
+	err := fw.rc.Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	fw.pending = false
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/upstream"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestGateway(t *testing.T, backend http.HandlerFunc) *httptest.Server {
+	upstreamSrv := httptest.NewServer(backend)
+	t.Cleanup(upstreamSrv.Close)
+
+	b := &config.Backend{URL: upstreamSrv.URL + "${path}", Timeout: 5}
+	gw := httptest.NewServer(CreateHttpProxyHandler(b, upstream.NewPool("test", b), nil, nil))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func TestRelayResponseStreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+	gw := newTestGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	})
+	defer close(release)
+
+	resp, err := http.Get(gw.URL + "/events")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+
+	select {
+	case l := <-line:
+		if l != "data: first\n" {
+			t.Errorf("first line = %q", l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event was not flushed before the response completed")
+	}
+}
+
+func TestRelayResponseTrailers(t *testing.T) {
+	gw := newTestGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+	})
+
+	resp, err := http.Get(gw.URL + "/file")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "body" {
+		t.Errorf("body = %q, want %q", body, "body")
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want %q", got, "abc")
+	}
+}
+
+func TestRelayResponseAbortsOnBackendError(t *testing.T) {
+	logs := &syncBuffer{}
+	out := logger.L.Out
+	logger.L.SetOutput(logs)
+	t.Cleanup(func() { logger.L.SetOutput(out) })
+
+	gw := newTestGateway(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	// Depending on what was flushed before the backend failed, the client either gets
+	// no response at all or a truncated body, but never a complete-looking one.
+	resp, err := http.Get(gw.URL + "/file")
+	if err == nil {
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err == nil {
+			t.Errorf("ReadAll() = %q, want a truncated body error", body)
+		}
+	}
+
+	// The connection is aborted once the error is logged.
+	for i := 0; !strings.Contains(logs.String(), "Error reading response from backend") && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := logs.String(); !strings.Contains(got, "Error reading response from backend") {
+		t.Errorf("logs = %q, want the backend error", got)
+	}
+}
+
+// syncBuffer is a buffer written by the handlers while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"github.com/go-chi/chi/v5"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// placeholderPattern matches the ${...} placeholders of backend URL templates.
+var placeholderPattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// processURL builds the URL of an upstream request from a backend URL template. Supported
+// placeholders are ${path} (the escaped request path), ${query} (the raw query string),
+// ${host} (the requested host name), ${param.<name>} (a route parameter) and
+// ${header.<name>} (a request header). Substituted parameters and headers are escaped.
+// Unless the template references ${query}, the raw query string of the request is
+// appended when appendQuery is set.
+func processURL(template string, r *http.Request, appendQuery bool) string {
+	usesQuery := false
+	processed := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[2 : len(placeholder)-1]
+		switch {
+		case name == "path":
+			return r.URL.EscapedPath()
+		case name == "query":
+			usesQuery = true
+			return r.URL.RawQuery
+		case name == "host":
+			return escapeComponent(requestHost(r))
+		case strings.HasPrefix(name, "param."):
+			return routeParam(r, strings.TrimPrefix(name, "param."))
+		case strings.HasPrefix(name, "header."):
+			return escapeComponent(r.Header.Get(strings.TrimPrefix(name, "header.")))
+		default:
+			return placeholder
+		}
+	})
+
+	if appendQuery && !usesQuery && r.URL.RawQuery != "" {
+		separator := "?"
+		if strings.Contains(processed, "?") {
+			separator = "&"
+		}
+		processed += separator + r.URL.RawQuery
+	}
+	return processed
+}
+
+// routeParam returns the escaped value of a route parameter of the request.
+func routeParam(r *http.Request, name string) string {
+	value := chi.URLParam(r, name)
+	// chi matches routes against the raw path when the request has one, in which case
+	// the parameter is escaped as the client chose to, and is escaped again our way.
+	if r.URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+	}
+	return escapeComponent(value)
+}
+
+// requestHost returns the requested host name, without its port.
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
+
+// escapeComponent escapes every character of the value but the unreserved ones of RFC 3986,
+// so that a substituted value cannot add path segments, query parameters, userinfo or a
+// port to the URL, wherever it is substituted.
+func escapeComponent(value string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
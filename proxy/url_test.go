@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_processURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		route       string
+		template    string
+		target      string
+		headers     map[string]string
+		appendQuery bool
+		want        string
+	}{
+		{
+			name:     "static",
+			route:    "/users",
+			template: "http://backend/api",
+			target:   "/users",
+			want:     "http://backend/api",
+		},
+		{
+			name:        "path and appended query",
+			route:       "/users/*",
+			template:    "http://backend${path}",
+			target:      "/users/a%20b?x=1&y=2",
+			appendQuery: true,
+			want:        "http://backend/users/a%20b?x=1&y=2",
+		},
+		{
+			name:        "query appended to existing query",
+			route:       "/users",
+			template:    "http://backend/api?v=2",
+			target:      "/users?x=1",
+			appendQuery: true,
+			want:        "http://backend/api?v=2&x=1",
+		},
+		{
+			name:     "query dropped",
+			route:    "/users",
+			template: "http://backend/api",
+			target:   "/users?x=1",
+			want:     "http://backend/api",
+		},
+		{
+			name:        "explicit query",
+			route:       "/users",
+			template:    "http://backend/api?${query}&v=2",
+			target:      "/users?x=1",
+			appendQuery: true,
+			want:        "http://backend/api?x=1&v=2",
+		},
+		{
+			name:     "params",
+			route:    "/users/{id}/posts/{post}",
+			template: "http://backend/v2/accounts/${param.id}?post=${param.post}",
+			target:   "/users/42/posts/a&b",
+			want:     "http://backend/v2/accounts/42?post=a%26b",
+		},
+		{
+			name:     "escaped param",
+			route:    "/files/{name}",
+			template: "http://backend/files/${param.name}",
+			target:   "/files/a%2Fb",
+			want:     "http://backend/files/a%2Fb",
+		},
+		{
+			name:     "header and host",
+			route:    "/",
+			template: "http://${header.X-Tenant}.backend/${host}",
+			target:   "/",
+			headers:  map[string]string{"X-Tenant": "acme/../x"},
+			want:     "http://acme%2F..%2Fx.backend/example.com",
+		},
+		{
+			name:     "header with userinfo and port",
+			route:    "/",
+			template: "http://${header.X-Tenant}.backend/api;v=${header.X-Version}",
+			target:   "/",
+			headers:  map[string]string{"X-Tenant": "evil.com:80@acme", "X-Version": "1;admin=true"},
+			want:     "http://evil.com%3A80%40acme.backend/api;v=1%3Badmin%3Dtrue",
+		},
+		{
+			name:     "escaped param with reserved characters",
+			route:    "/files/{name}",
+			template: "http://backend/files/${param.name}",
+			target:   "/files/a%2Fb:c@d",
+			want:     "http://backend/files/a%2Fb%3Ac%40d",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			router := chi.NewRouter()
+			router.Get(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				got = processURL(tt.template, r, tt.appendQuery)
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com:8080"+tt.target, nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("processURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
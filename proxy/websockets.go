@@ -1,43 +1,240 @@
 package proxy
 
 import (
+	"compress/flate"
+	"errors"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 	"github.com/yarlson/GateH8/client"
 	"github.com/yarlson/GateH8/config"
 	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/tracing"
+	"github.com/yarlson/GateH8/upstream"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// defaultHandshakeTimeout bounds the backend handshake when the backend has no timeout configured.
+const defaultHandshakeTimeout = 45 * time.Second
+
+// defaultCompressionLevel is the compression level of the WebSocket legs using permessage-deflate.
+const defaultCompressionLevel = flate.BestSpeed
+
+// webSocketHeaders are the handshake headers negotiated separately on each leg of a
+// WebSocket session. They are never copied from one leg to the other.
+var webSocketHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Accept",
+}
+
 // CreateWebSocketProxyHandler creates a handler that handles incoming WebSocket
 // connections from clients. This handler is primarily responsible for setting up the initial
 // connection but delegates the actual message handling to the WebSocketProxyClient.
-func CreateWebSocketProxyHandler(endpoint config.Endpoint) http.HandlerFunc {
+// Sessions are tracked in sessions until both of their connections are closed.
+func CreateWebSocketProxyHandler(endpoint config.Endpoint, pool *upstream.Pool, sessions *client.Sessions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Set up the WebSocket connection with the proxyClient using predefined parameters.
-		// This establishes a full-duplex communication channel between the proxyClient and the proxy server.
+		log := logger.FromContext(r.Context())
 		upgrader := getWebSocketUpgrader(endpoint)
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		// Reject invalid handshakes before reaching out to the backend.
+		if !websocket.IsWebSocketUpgrade(r) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if !upgrader.CheckOrigin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// Enforce the connection limits of the endpoint. They are kept across configuration reloads.
+		if limits := endpoint.WebSocket.Limits; limits != nil && (limits.MaxConnections > 0 || limits.MaxConnectionsPerIP > 0) {
+			release, err := sessions.Admit(pool.Name(), remoteIP(r.RemoteAddr), limits.MaxConnections, limits.MaxConnectionsPerIP)
+			if err != nil {
+				log.WithError(err).Warn("WebSocket connection rejected")
+				if errors.Is(err, client.ErrTooManyConnectionsPerIP) {
+					http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				} else {
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				}
+				return
+			}
+			defer release()
+		}
+
+		// Pick the backend target before upgrading, so that an unavailable backend
+		// can still be reported to the client with a regular HTTP error.
+		target, err := pool.Next(r)
 		if err != nil {
-			logger.L.Error("Failed to establish a WebSocket connection with the proxyClient:", err)
+			log.WithError(err).Error("Error selecting upstream target")
+			writeUnavailable(w, endpoint.Backend, err)
 			return
 		}
-		logger.L.Info("The connection has been upgraded")
+		target.Acquire()
+		defer target.Release()
+
+		// The backend handshake comes first, so that the client is only accepted once the
+		// backend has accepted the session, with the subprotocol the backend chose.
+		backendConn, resp, err := dialBackend(r, pool.Name(), endpoint, target)
+		if err != nil {
+			if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+				// The backend refused the session: let the client know why.
+				target.Report(resp.StatusCode < http.StatusInternalServerError)
+				log.WithFields(logrus.Fields{"target": target.URL, "status": resp.StatusCode}).Warn("WebSocket handshake rejected by the backend")
+				relayHandshakeRejection(w, r, resp)
+				return
+			}
+			target.Report(false)
+			log.WithError(err).WithField("target", target.URL).Error("Failed to establish a WebSocket connection with the backend")
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		target.Report(true)
+		defer backendConn.Close()
+		setCompressionLevel(log, backendConn, endpoint.WebSocket.Compression)
+
+		// Set up the WebSocket connection with the proxyClient using predefined parameters.
+		// This establishes a full-duplex communication channel between the proxyClient and the proxy server.
+		conn, err := upgrader.Upgrade(w, r, upgradeHeaders(resp, backendConn.Subprotocol()))
+		if err != nil {
+			log.WithError(err).Error("Failed to establish a WebSocket connection with the client")
+			return
+		}
+		log.Info("The connection has been upgraded")
 		defer conn.Close()
+		setCompressionLevel(log, conn, endpoint.WebSocket.Compression)
 
 		// The actual business logic of relaying messages between the proxyClient and a backend
 		// WebSocket service is managed by the WebSocketProxyClient.
-		proxyClient := client.NewWebSocketProxyClient(endpoint, conn)
-		proxyClient.HandleProxy()
+		proxyClient := client.NewWebSocketProxyClient(pool.Name(), endpoint, target, conn, backendConn, sessions)
+		proxyClient.HandleProxy(r)
+	}
+}
+
+// dialBackend opens the backend leg of a WebSocket session. The target URL is expanded like
+// HTTP backend URLs, the handshake headers of the client are forwarded according to the
+// endpoint's configuration, and the subprotocols requested by the client are offered to the backend.
+// The handshake is traced as a request to the backend named name.
+func dialBackend(r *http.Request, name string, endpoint config.Endpoint, target *upstream.Target) (*websocket.Conn, *http.Response, error) {
+	timeout := time.Duration(endpoint.Backend.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: timeout,
+		ReadBufferSize:   endpoint.WebSocket.ReadBufferSize,
+		WriteBufferSize:  endpoint.WebSocket.WriteBufferSize,
+		Subprotocols:     websocket.Subprotocols(r),
+	}
+	if c := endpoint.WebSocket.Compression; c != nil {
+		dialer.EnableCompression = c.Backend
+	}
+
+	backendURL := processURL(target.URL, r, endpoint.Backend.AppendsQuery())
+	header := handshakeHeaders(r, endpoint.WebSocket.ForwardHeaders)
+
+	ctx, span := tracing.StartUpstream(r.Context(), name, http.MethodGet, backendURL, header)
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, backendURL, header)
+	if u, parseErr := url.Parse(backendURL); parseErr == nil {
+		logger.RecordUpstream(r.Context(), u.Host, time.Since(start))
+	}
+	tracing.EndUpstream(span, statusCode(resp), err)
+	return conn, resp, err
+}
+
+// handshakeHeaders returns the headers of the backend handshake. The client's end-to-end
+// headers are forwarded, or only the ones listed in forward unless it contains "*", along
+// with the X-Forwarded-* and Forwarded headers.
+func handshakeHeaders(r *http.Request, forward []string) http.Header {
+	in := r.Header
+	if len(forward) > 0 && !contains(forward, "*") {
+		in = make(http.Header, len(forward))
+		for _, name := range forward {
+			if values := r.Header.Values(name); len(values) > 0 {
+				in[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+
+	src := r.WithContext(r.Context())
+	src.Header = in
+
+	req := &http.Request{}
+	copyRequestHeaders(req, src)
+	for _, name := range webSocketHeaders {
+		req.Header.Del(name)
+	}
+	return req.Header
+}
+
+// upgradeHeaders returns the headers of the client handshake response: the end-to-end
+// headers of the backend's handshake response, such as cookies, and the subprotocol it selected.
+func upgradeHeaders(resp *http.Response, subprotocol string) http.Header {
+	h := resp.Header.Clone()
+	removeHopHeaders(h)
+	for _, name := range webSocketHeaders {
+		h.Del(name)
+	}
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	return h
+}
+
+// relayHandshakeRejection relays the response of a backend that refused the WebSocket
+// handshake, such as a 401, to the client.
+func relayHandshakeRejection(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	defer resp.Body.Close()
+
+	// Only the beginning of the body is kept by the dialer, so the length is recomputed.
+	resp.Header.Del("Content-Length")
+	for _, name := range webSocketHeaders {
+		resp.Header.Del(name)
+	}
+	relayResponse(w, r, resp, 0)
+}
+
+// setCompressionLevel sets the compression level of a connection, which only applies
+// when permessage-deflate was negotiated on it.
+func setCompressionLevel(log *logrus.Entry, conn *websocket.Conn, compression *config.WebSocketCompression) {
+	if err := conn.SetCompressionLevel(compressionLevel(compression)); err != nil {
+		log.WithError(err).Error("Error setting the WebSocket compression level")
+	}
+}
+
+// compressionLevel returns the configured compression level, or the default one.
+func compressionLevel(compression *config.WebSocketCompression) int {
+	if compression == nil || compression.Level == nil {
+		return defaultCompressionLevel
+	}
+	return *compression.Level
+}
+
+// contains reports whether the list contains the value, ignoring case.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
 	}
+	return false
 }
 
 // getWebSocketUpgrader returns a configured WebSocket upgrader. The upgrader handles the
 // specifics of upgrading an HTTP connection to a WebSocket connection based on predefined parameters.
 func getWebSocketUpgrader(endpoint config.Endpoint) websocket.Upgrader {
+	compression := endpoint.WebSocket.Compression
 	return websocket.Upgrader{
-		ReadBufferSize:  endpoint.WebSocket.ReadBufferSize,
-		WriteBufferSize: endpoint.WebSocket.WriteBufferSize,
+		ReadBufferSize:    endpoint.WebSocket.ReadBufferSize,
+		WriteBufferSize:   endpoint.WebSocket.WriteBufferSize,
+		EnableCompression: compression != nil && compression.Client,
 		CheckOrigin: func(r *http.Request) bool {
 			// Check the origin of the request to ensure it comes from a trusted source.
 			// This prevents unauthorized access and potential security breaches.
@@ -47,7 +244,7 @@ func getWebSocketUpgrader(endpoint config.Endpoint) websocket.Upgrader {
 					return true
 				}
 			}
-			logger.L.Error()
+			logger.FromContext(r.Context()).WithField("origin", origin).Warn("WebSocket origin not allowed")
 			return false
 		},
 	}
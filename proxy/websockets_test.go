@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"compress/flate"
+	"github.com/gorilla/websocket"
+	"github.com/yarlson/GateH8/client"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/upstream"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketHandshake(t *testing.T) {
+	tests := []struct {
+		name           string
+		forwardHeaders []string
+		compression    *config.WebSocketCompression
+		backend        func(w http.ResponseWriter, r *http.Request)
+		check          func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request)
+	}{
+		{
+			name: "headers, subprotocol, path and query",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{Subprotocols: []string{"v2.chat"}}
+				conn, err := upgrader.Upgrade(w, r, http.Header{"Set-Cookie": {"session=1"}})
+				if err == nil {
+					_ = conn.Close()
+				}
+			},
+			check: func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request) {
+				if err != nil {
+					t.Fatalf("Dial() error = %v", err)
+				}
+				if conn.Subprotocol() != "v2.chat" {
+					t.Errorf("Subprotocol() = %q, want v2.chat", conn.Subprotocol())
+				}
+				if got := resp.Header.Get("Set-Cookie"); got != "session=1" {
+					t.Errorf("Set-Cookie = %q, want session=1", got)
+				}
+				if got := backendReq.URL.String(); got != "/ws/room?id=1" {
+					t.Errorf("backend URL = %q, want /ws/room?id=1", got)
+				}
+				if got := backendReq.Header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("Authorization = %q, want Bearer token", got)
+				}
+				if got := backendReq.Header.Get("Cookie"); got != "a=b" {
+					t.Errorf("Cookie = %q, want a=b", got)
+				}
+				if got := backendReq.Header.Get("X-Forwarded-For"); got != "127.0.0.1" {
+					t.Errorf("X-Forwarded-For = %q, want 127.0.0.1", got)
+				}
+			},
+		},
+		{
+			name:           "selected headers",
+			forwardHeaders: []string{"authorization"},
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err == nil {
+					_ = conn.Close()
+				}
+			},
+			check: func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request) {
+				if err != nil {
+					t.Fatalf("Dial() error = %v", err)
+				}
+				if conn.Subprotocol() != "" {
+					t.Errorf("Subprotocol() = %q, want none", conn.Subprotocol())
+				}
+				if got := backendReq.Header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("Authorization = %q, want Bearer token", got)
+				}
+				if got := backendReq.Header.Get("Cookie"); got != "" {
+					t.Errorf("Cookie = %q, want none", got)
+				}
+				if got := backendReq.Header.Get("Forwarded"); got == "" {
+					t.Error("Forwarded header is missing")
+				}
+			},
+		},
+		{
+			name:        "compression on both legs",
+			compression: &config.WebSocketCompression{Client: true, Backend: true, Level: intPtr(6)},
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{EnableCompression: true}).Upgrade(w, r, nil)
+				if err == nil {
+					_ = conn.Close()
+				}
+			},
+			check: func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request) {
+				if err != nil {
+					t.Fatalf("Dial() error = %v", err)
+				}
+				if got := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(got, "permessage-deflate") {
+					t.Errorf("client leg extensions = %q, want permessage-deflate", got)
+				}
+				if got := backendReq.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(got, "permessage-deflate") {
+					t.Errorf("backend leg extensions = %q, want permessage-deflate", got)
+				}
+			},
+		},
+		{
+			name:        "compression on the client leg only",
+			compression: &config.WebSocketCompression{Client: true},
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				conn, err := (&websocket.Upgrader{EnableCompression: true}).Upgrade(w, r, nil)
+				if err == nil {
+					_ = conn.Close()
+				}
+			},
+			check: func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request) {
+				if err != nil {
+					t.Fatalf("Dial() error = %v", err)
+				}
+				if got := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(got, "permessage-deflate") {
+					t.Errorf("client leg extensions = %q, want permessage-deflate", got)
+				}
+				if got := backendReq.Header.Get("Sec-WebSocket-Extensions"); got != "" {
+					t.Errorf("backend leg extensions = %q, want none", got)
+				}
+			},
+		},
+		{
+			name: "rejection",
+			backend: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+			},
+			check: func(t *testing.T, conn *websocket.Conn, resp *http.Response, err error, backendReq *http.Request) {
+				if err != websocket.ErrBadHandshake {
+					t.Fatalf("Dial() error = %v, want bad handshake", err)
+				}
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+				}
+				if got := resp.Header.Get("WWW-Authenticate"); got != `Bearer realm="chat"` {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if strings.TrimSpace(string(body)) != "invalid token" {
+					t.Errorf("body = %q, want invalid token", body)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendReqs := make(chan *http.Request, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				backendReqs <- r.Clone(r.Context())
+				tt.backend(w, r)
+			}))
+			defer backend.Close()
+
+			endpoint := config.Endpoint{
+				Path:      "/ws/*",
+				Backend:   &config.Backend{URL: "ws" + strings.TrimPrefix(backend.URL, "http") + "${path}"},
+				WebSocket: &config.WebSocketConfig{AllowedOrigins: []string{"*"}, ForwardHeaders: tt.forwardHeaders, Compression: tt.compression},
+			}
+			handler := CreateWebSocketProxyHandler(endpoint, upstream.NewPool("test", endpoint.Backend), client.NewSessions())
+			gw := httptest.NewServer(handler)
+			defer gw.Close()
+
+			dialer := websocket.Dialer{Subprotocols: []string{"v1.chat", "v2.chat"}, EnableCompression: true}
+			header := http.Header{"Authorization": {"Bearer token"}, "Cookie": {"a=b"}}
+			conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(gw.URL, "http")+"/ws/room?id=1", header)
+			if conn != nil {
+				defer conn.Close()
+			}
+
+			tt.check(t, conn, resp, err, <-backendReqs)
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestCompressionLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression *config.WebSocketCompression
+		want        int
+	}{
+		{name: "no compression settings", want: flate.BestSpeed},
+		{name: "default", compression: &config.WebSocketCompression{Client: true}, want: flate.BestSpeed},
+		{name: "no compression", compression: &config.WebSocketCompression{Client: true, Level: intPtr(0)}, want: flate.NoCompression},
+		{name: "huffman only", compression: &config.WebSocketCompression{Client: true, Level: intPtr(-2)}, want: flate.HuffmanOnly},
+		{name: "best compression", compression: &config.WebSocketCompression{Client: true, Level: intPtr(9)}, want: flate.BestCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compressionLevel(tt.compression); got != tt.want {
+				t.Errorf("compressionLevel() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package retry
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"sync"
+	"time"
+)
+
+// Budget defaults, used when no budget is configured.
+const (
+	defaultBudgetRatio         = 0.2
+	defaultMinRetriesPerSecond = 10
+	budgetWindow               = 10
+)
+
+// Budget limits the number of retries relative to the number of requests, over a
+// sliding window of ten one-second buckets.
+type Budget struct {
+	ratio      float64
+	minRetries int
+
+	mu       sync.Mutex
+	requests [budgetWindow]int
+	retries  [budgetWindow]int
+	stamps   [budgetWindow]int64
+	now      func() time.Time
+}
+
+// NewBudget creates a Budget from its configuration, falling back to a 20% ratio with
+// ten retries per second when no budget is configured.
+func NewBudget(c *config.RetryBudget) *Budget {
+	b := &Budget{
+		ratio:      defaultBudgetRatio,
+		minRetries: defaultMinRetriesPerSecond,
+		now:        time.Now,
+	}
+	if c != nil {
+		b.ratio = c.Ratio
+		b.minRetries = c.MinRetriesPerSecond
+	}
+	return b
+}
+
+// Deposit records a request that may later be retried.
+func (b *Budget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.requests[b.bucket()]++
+}
+
+// Withdraw reserves a retry, returning false when the budget is exhausted.
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.bucket()
+	requests, retries := 0, 0
+	for i := range b.requests {
+		requests += b.requests[i]
+		retries += b.retries[i]
+	}
+
+	allowed := int(float64(requests) * b.ratio)
+	if floor := b.minRetries * budgetWindow; allowed < floor {
+		allowed = floor
+	}
+	if retries >= allowed {
+		return false
+	}
+	b.retries[current]++
+	return true
+}
+
+// bucket returns the index of the bucket of the current second, resetting stale buckets.
+func (b *Budget) bucket() int {
+	second := b.now().Unix()
+	i := int(second % budgetWindow)
+	if b.stamps[i] != second {
+		b.stamps[i] = second
+		b.requests[i], b.retries[i] = 0, 0
+	}
+
+	// Buckets that were not touched for a whole window are stale as well.
+	for j := range b.stamps {
+		if second-b.stamps[j] >= budgetWindow {
+			b.requests[j], b.retries[j] = 0, 0
+		}
+	}
+	return i
+}
@@ -0,0 +1,150 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/yarlson/GateH8/config"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Retry policy defaults, used when the corresponding setting is left empty.
+const (
+	defaultBackoffBase = 25 * time.Millisecond
+	defaultBackoffMax  = time.Second
+	defaultMaxBodySize = 1 << 20
+)
+
+var (
+	defaultRetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	defaultMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodPut, http.MethodDelete, http.MethodTrace,
+	}
+)
+
+// Policy decides whether and when a failed attempt to reach a backend is retried.
+type Policy struct {
+	attempts    int
+	retryOn     map[int]bool
+	errors      map[string]bool
+	methods     map[string]bool
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	maxBodySize int64
+	budget      *Budget
+}
+
+// NewPolicy builds a Policy from its configuration. Retries are additionally limited by
+// the budget, which may be shared across policies. A nil configuration yields a nil
+// policy, which never retries.
+func NewPolicy(c *config.RetryPolicy, budget *Budget) *Policy {
+	if c == nil {
+		return nil
+	}
+
+	p := &Policy{
+		attempts:    c.Attempts,
+		retryOn:     make(map[int]bool),
+		errors:      make(map[string]bool),
+		methods:     make(map[string]bool),
+		backoffBase: c.Backoff.Base.Or(defaultBackoffBase),
+		backoffMax:  c.Backoff.Max.Or(defaultBackoffMax),
+		maxBodySize: c.MaxBodySize,
+		budget:      budget,
+	}
+	if p.maxBodySize <= 0 {
+		p.maxBodySize = defaultMaxBodySize
+	}
+
+	retryOn := c.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	for _, status := range retryOn {
+		p.retryOn[status] = true
+	}
+
+	errorClasses := c.RetryOnErrors
+	if len(errorClasses) == 0 {
+		errorClasses = []string{config.RetryOnAny}
+	}
+	for _, class := range errorClasses {
+		p.errors[class] = true
+	}
+
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = defaultMethods
+	}
+	for _, method := range methods {
+		p.methods[method] = true
+	}
+
+	return p
+}
+
+// Attempts returns the maximum number of attempts, including the first one, for the request.
+func (p *Policy) Attempts(r *http.Request) int {
+	if p == nil || !p.methods[r.Method] {
+		return 1
+	}
+	return p.attempts
+}
+
+// Track records a request against the retry budget of the policy.
+func (p *Policy) Track() {
+	if p != nil && p.budget != nil {
+		p.budget.Deposit()
+	}
+}
+
+// MaxBodySize returns the size of the largest request body that is buffered for replay.
+func (p *Policy) MaxBodySize() int64 {
+	return p.maxBodySize
+}
+
+// Retryable reports whether the outcome of an attempt (either a response or a transport error) should be retried.
+func (p *Policy) Retryable(resp *http.Response, err error) bool {
+	if p == nil {
+		return false
+	}
+	if err == nil {
+		return p.retryOn[resp.StatusCode]
+	}
+	if p.errors[config.RetryOnAny] {
+		return true
+	}
+
+	var netErr net.Error
+	if p.errors[config.RetryOnTimeout] && errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return p.errors[config.RetryOnConnect] && errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Wait sleeps before the given retry (starting at 1) using an exponential backoff with
+// full jitter. It returns false without retrying when the retry budget is exhausted or
+// the context is done.
+func (p *Policy) Wait(ctx context.Context, retry int) bool {
+	if p.budget != nil && !p.budget.Withdraw() {
+		return false
+	}
+
+	backoff := p.backoffBase << (retry - 1)
+	if backoff > p.backoffMax || backoff <= 0 {
+		backoff = p.backoffMax
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,102 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/yarlson/GateH8/config"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPolicyAttempts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *config.RetryPolicy
+		method string
+		want   int
+	}{
+		{name: "no policy", config: nil, method: http.MethodGet, want: 1},
+		{name: "idempotent", config: &config.RetryPolicy{Attempts: 3}, method: http.MethodGet, want: 3},
+		{name: "not idempotent", config: &config.RetryPolicy{Attempts: 3}, method: http.MethodPost, want: 1},
+		{name: "explicit methods", config: &config.RetryPolicy{Attempts: 2, Methods: []string{http.MethodPost}}, method: http.MethodPost, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, "/", nil)
+			if got := NewPolicy(tt.config, nil).Attempts(r); got != tt.want {
+				t.Errorf("Attempts() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+
+	tests := []struct {
+		name   string
+		config *config.RetryPolicy
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "default status", config: &config.RetryPolicy{Attempts: 2}, status: http.StatusBadGateway, want: true},
+		{name: "not retryable status", config: &config.RetryPolicy{Attempts: 2}, status: http.StatusInternalServerError, want: false},
+		{name: "configured status", config: &config.RetryPolicy{Attempts: 2, RetryOn: []int{500}}, status: http.StatusInternalServerError, want: true},
+		{name: "any error", config: &config.RetryPolicy{Attempts: 2}, err: readErr, want: true},
+		{name: "connect error", config: &config.RetryPolicy{Attempts: 2, RetryOnErrors: []string{config.RetryOnConnect}}, err: dialErr, want: true},
+		{name: "not connect error", config: &config.RetryPolicy{Attempts: 2, RetryOnErrors: []string{config.RetryOnConnect}}, err: readErr, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := NewPolicy(tt.config, nil).Retryable(resp, tt.err); got != tt.want {
+				t.Errorf("Retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyWaitCancelled(t *testing.T) {
+	p := NewPolicy(&config.RetryPolicy{
+		Attempts: 2,
+		Backoff:  config.BackoffConfig{Base: config.Duration(time.Hour), Max: config.Duration(time.Hour)},
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p.Wait(ctx, 1) {
+		t.Errorf("Wait() = true with a cancelled context")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBudget(&config.RetryBudget{Ratio: 0.5, MinRetriesPerSecond: 0})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		b.Deposit()
+	}
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if b.Withdraw() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Withdraw() allowed %d retries, want 5", allowed)
+	}
+
+	// Once the window has passed, the budget only relies on new requests.
+	now = now.Add(budgetWindow * time.Second)
+	if b.Withdraw() {
+		t.Errorf("Withdraw() = true with an empty window")
+	}
+}
@@ -1,15 +1,22 @@
 package router
 
 import (
+	"crypto/x509"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/yarlson/GateH8/auth"
+	"github.com/yarlson/GateH8/client"
 	"github.com/yarlson/GateH8/config"
 	"github.com/yarlson/GateH8/logger"
+	"github.com/yarlson/GateH8/metrics"
 	"github.com/yarlson/GateH8/proxy"
+	"github.com/yarlson/GateH8/retry"
+	"github.com/yarlson/GateH8/tracing"
+	"github.com/yarlson/GateH8/upstream"
 	"net"
 	"net/http"
-	"path/filepath"
 )
 
 // generateCORS creates a CORS middleware handler based on a given configuration.
@@ -26,20 +33,24 @@ func generateCORS(c *config.CORSConfig) func(http.Handler) http.Handler {
 }
 
 // WildcardHostRouter is a router that handles hostnames with wildcards and discards ports.
+// Exact hostnames take precedence over wildcard patterns, see config.VhostMatcher.
 type WildcardHostRouter struct {
-	routes map[string]*chi.Mux
+	routes  map[string]*chi.Mux
+	matcher *config.VhostMatcher
 }
 
 // NewWildcardHostRouter initializes a new WildcardHostRouter.
 func NewWildcardHostRouter() *WildcardHostRouter {
 	return &WildcardHostRouter{
-		routes: make(map[string]*chi.Mux),
+		routes:  make(map[string]*chi.Mux),
+		matcher: config.NewVhostMatcher(),
 	}
 }
 
 // Map maps a host pattern to a router.
 func (whr *WildcardHostRouter) Map(pattern string, router *chi.Mux) {
 	whr.routes[pattern] = router
+	whr.matcher.Add(pattern)
 }
 
 // Route routes based on host patterns.
@@ -48,11 +59,9 @@ func (whr *WildcardHostRouter) Route(w http.ResponseWriter, r *http.Request) {
 	if host == "" {
 		host = r.Host // in case SplitHostPort failed, which means there was no port
 	}
-	for pattern, router := range whr.routes {
-		if matched, _ := filepath.Match(pattern, host); matched {
-			router.ServeHTTP(w, r)
-			return
-		}
+	if pattern, ok := whr.matcher.Match(host); ok {
+		whr.routes[pattern].ServeHTTP(w, r)
+		return
 	}
 	http.Error(w, "Host not found", http.StatusNotFound)
 }
@@ -62,25 +71,94 @@ func (whr *WildcardHostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	whr.Route(w, r)
 }
 
+// Router is the handler of the routes built from a configuration.
+type Router struct {
+	*chi.Mux
+	routes map[string][]Route
+}
+
+// Route describes an endpoint as compiled into the router, for introspection.
+type Route struct {
+	Path      string   `json:"path"`
+	Methods   []string `json:"methods,omitempty"`
+	WebSocket bool     `json:"websocket,omitempty"`
+	Backend   string   `json:"backend"`
+	Targets   []string `json:"targets"`
+}
+
+// RouteTable returns the routes of every vhost, in the order of the configuration.
+func (r *Router) RouteTable() map[string][]Route {
+	return r.routes
+}
+
 // NewRouter constructs a new router based on a given configuration.
 // The router manages incoming requests, directing them to the appropriate backend based on the requested host and path.
 // Each virtual host (vhost) can have its own set of endpoints and CORS settings.
 // Endpoints can additionally override the vhost's CORS settings if needed.
-func NewRouter(config *config.Config) *chi.Mux {
+// Upstream pools are registered in the given registry, which owns their health checks,
+// HTTP backends are reached through the clients of their upstream in transports, WebSocket sessions are tracked in sessions,
+// vhosts are put in maintenance mode through maintenance, and the requests are logged to accessLog.
+// Requests are authenticated with the client certificate, JWT, API key or Basic authentication
+// of their endpoint, or of its vhost, and authorized by the forward authentication service of their endpoint,
+// before being proxied.
+func NewRouter(config *config.Config, registry *upstream.Registry, transports *client.Transports, sessions *client.Sessions, maintenance *proxy.Maintenance, accessLog *logger.AccessLog) (*Router, error) {
 	r := chi.NewRouter()
+	routes := make(map[string][]Route, len(config.Vhosts))
+
+	// Only the forwarding headers set by trusted proxies are taken into account.
+	trusted := proxy.ParseTrustedProxies(config)
 
 	// Middleware layers to enrich request context and manage common API functionalities.
-	r.Use(middleware.RequestID) // Assigns a unique ID to each request.
-	r.Use(middleware.RealIP)    // Fetches the real IP from headers, useful if behind a proxy.
-	r.Use(logger.JsonLogger)    // A custom logger for logging request/response in JSON format.
-	r.Use(middleware.Recoverer) // Recovers from panics and logs the stack trace.
+	r.Use(middleware.RequestID)  // Assigns a unique ID to each request.
+	r.Use(proxy.RealIP(trusted)) // Fetches the real IP from headers, if the request comes from a trusted proxy.
+	r.Use(accessLog.Middleware)  // Logs the requests in the configured format.
+	r.Use(middleware.Recoverer)  // Recovers from panics and logs the stack trace.
 
 	hr := NewWildcardHostRouter() // A router to manage routing based on request host (vhost).
 
+	// The API consumers are shared by all the endpoints authenticating them.
+	consumers := auth.NewConsumers(config.Consumers)
+
+	// Each htpasswd file is read once, however many endpoints use it.
+	htpasswd := make(map[string]*auth.Htpasswd)
+
+	// The retry budget is shared by all the endpoints to prevent retry storms.
+	budget := retry.NewBudget(config.RetryBudget)
+
 	// Iterate over each virtual host in the configuration.
 	for vhost, vhostConfig := range config.Vhosts {
 		router := chi.NewRouter()
 
+		// Trace the requests served by the vhost, if configured, and record their metrics.
+		if config.Tracing != nil {
+			router.Use(tracing.Middleware(vhost))
+		}
+		router.Use(metrics.Middleware(vhost))
+		router.Use(logger.WithVhost(vhost, vhostConfig.Log, config.Log))
+		router.Use(maintenance.Middleware(vhost, vhostConfig.MaintenanceResponse))
+
+		// Enforce the client certificate mode of the vhost, and forward the certificates to the backends.
+		if vhostConfig.TLS != nil && vhostConfig.TLS.ClientAuth != nil {
+			clientAuth := vhostConfig.TLS.ClientAuth
+			var roots *x509.CertPool
+			if clientAuth.CAFile != "" {
+				var err error
+				if roots, err = auth.ReadClientCAs(clientAuth.CAFile); err != nil {
+					return nil, fmt.Errorf("vhost %s: %w", vhost, err)
+				}
+			}
+			router.Use(auth.ClientAuth(clientAuth, roots))
+		}
+
+		// The JWT validation of the vhost is shared by its endpoints, along with its JWKS cache.
+		var vhostJWT *auth.JWT
+		if vhostConfig.JWT != nil && !vhostConfig.JWT.Disabled {
+			var err error
+			if vhostJWT, err = auth.NewJWT(vhostConfig.JWT); err != nil {
+				return nil, fmt.Errorf("vhost %s: %w", vhost, err)
+			}
+		}
+
 		// Apply vhost level CORS if specified.
 		if vhostConfig.CORS != nil {
 			router.Use(generateCORS(vhostConfig.CORS))
@@ -100,14 +178,78 @@ func NewRouter(config *config.Config) *chi.Mux {
 				router.Mount(endpoint.Path, endpointRouter)
 			}
 
+			// The upstream pool is shared by all the methods of the endpoint.
+			pool := registry.NewPool(vhost+endpoint.Path, endpoint.Backend)
+			route := Route{Path: endpoint.Path, WebSocket: endpoint.WebSocket != nil, Backend: pool.Name()}
+			for _, target := range pool.Targets() {
+				route.Targets = append(route.Targets, target.URL)
+			}
+
+			// The log lines of the endpoint's requests carry its path.
+			handlers := endpointRouter.With(logger.WithEndpoint(endpoint.Path))
+
+			// Endpoints can be restricted to the clients with an allowed certificate.
+			if endpoint.ClientCert != nil {
+				handlers = handlers.With(auth.ClientCert(endpoint.ClientCert))
+			}
+
+			// Endpoints can override the JWT validation of their vhost, or turn it off.
+			jwt := vhostJWT
+			if endpoint.JWT != nil && endpoint.JWT.Disabled {
+				jwt = nil
+			} else if endpoint.JWT != nil {
+				var err error
+				if jwt, err = auth.NewJWT(endpoint.JWT); err != nil {
+					return nil, fmt.Errorf("endpoint %s%s: %w", vhost, endpoint.Path, err)
+				}
+			}
+			if jwt != nil {
+				handlers = handlers.With(jwt.Middleware)
+			}
+
+			// Endpoints can override the API key authentication of their vhost.
+			apiKey := vhostConfig.APIKey
+			if endpoint.APIKey != nil {
+				apiKey = endpoint.APIKey
+			}
+			if apiKey != nil {
+				handlers = handlers.With(auth.APIKey(apiKey, consumers, vhost, endpoint.Path))
+			}
+
+			// Endpoints can override the Basic authentication of their vhost.
+			basicAuth := vhostConfig.BasicAuth
+			if endpoint.BasicAuth != nil {
+				basicAuth = endpoint.BasicAuth
+			}
+			if basicAuth != nil {
+				users, ok := htpasswd[basicAuth.HtpasswdFile]
+				if !ok {
+					var err error
+					if users, err = auth.ReadHtpasswd(basicAuth.HtpasswdFile); err != nil {
+						return nil, fmt.Errorf("endpoint %s%s: %w", vhost, endpoint.Path, err)
+					}
+					htpasswd[basicAuth.HtpasswdFile] = users
+				}
+				handlers = handlers.With(auth.BasicAuth(basicAuth, users))
+			}
+
+			// Authorize the requests with an external service, once the client is authenticated.
+			if endpoint.ForwardAuth != nil {
+				handlers = handlers.With(proxy.NewForwardAuth(endpoint.ForwardAuth, transports.Client(client.Origin(endpoint.ForwardAuth.URL), nil)).Middleware)
+			}
+
 			// Bind all the allowed methods for the endpoint to the respective handler.
 			if endpoint.WebSocket != nil {
-				endpointRouter.HandleFunc(endpoint.Path, proxy.CreateWebSocketProxyHandler(endpoint))
+				handlers.HandleFunc(endpoint.Path, proxy.CreateWebSocketProxyHandler(endpoint, pool, sessions))
 			} else {
+				route.Methods = endpoint.Methods
+				policy := retry.NewPolicy(endpoint.Retry, budget)
+				httpClient := transports.Client(client.Upstream(endpoint.Backend), endpoint.Backend.Transport)
 				for _, method := range endpoint.Methods {
-					endpointRouter.Method(method, endpoint.Path, proxy.CreateHttpProxyHandler(endpoint.Backend, &http.Client{}))
+					handlers.Method(method, endpoint.Path, proxy.CreateHttpProxyHandler(endpoint.Backend, pool, policy, httpClient))
 				}
 			}
+			routes[vhost] = append(routes[vhost], route)
 		}
 
 		// Map the constructed vhost router to the corresponding host.
@@ -116,5 +258,5 @@ func NewRouter(config *config.Config) *chi.Mux {
 
 	// Mount the host router to the main router.
 	r.Mount("/", hr)
-	return r
+	return &Router{Mux: r, routes: routes}, nil
 }
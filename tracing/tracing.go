@@ -0,0 +1,219 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+// defaultServiceName is the name the traces are reported under when neither the tracing
+// configuration nor the apiGateway section name the service.
+const defaultServiceName = "GateH8"
+
+// Attributes describing where a request was routed.
+const (
+	VhostKey     = attribute.Key("gateh8.vhost")
+	EndpointKey  = attribute.Key("gateh8.endpoint")
+	BackendKey   = attribute.Key("gateh8.backend")
+	RequestIDKey = attribute.Key("gateh8.request_id")
+)
+
+// tracer creates the spans of the gateway. It follows the tracer provider installed by Setup.
+var tracer = otel.Tracer("github.com/yarlson/GateH8")
+
+// Setup installs the tracer provider and the propagators described by the configuration.
+// The returned function flushes the pending spans and stops the exporter. Without tracing
+// configured, spans are not recorded and the trace context of the requests is relayed as is.
+func Setup(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	t := cfg.Tracing
+	if t == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s trace exporter: %w", t.Exporter, err)
+	}
+
+	serviceName := t.ServiceName
+	if serviceName == "" {
+		serviceName = cfg.APIGateway.Name
+	}
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	ratio := 1.0
+	if t.SampleRatio != nil {
+		ratio = *t.SampleRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(cfg.APIGateway.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(newPropagator(t.Propagators))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.L.Warn("Tracing error: ", err)
+	}))
+
+	return provider.Shutdown, nil
+}
+
+// newExporter creates the OTLP exporter of the spans. The endpoint is either a host and
+// port or a URL; the exporters' defaults and environment variables apply when it is empty.
+func newExporter(ctx context.Context, t *config.Tracing) (sdktrace.SpanExporter, error) {
+	isURL := strings.Contains(t.Endpoint, "://")
+
+	if t.Exporter == config.ExporterOTLPHTTP {
+		var opts []otlptracehttp.Option
+		switch {
+		case isURL:
+			opts = append(opts, otlptracehttp.WithEndpointURL(t.Endpoint))
+		case t.Endpoint != "":
+			opts = append(opts, otlptracehttp.WithEndpoint(t.Endpoint))
+		}
+		if t.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(t.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(t.Headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	var opts []otlptracegrpc.Option
+	switch {
+	case isURL:
+		opts = append(opts, otlptracegrpc.WithEndpointURL(t.Endpoint))
+	case t.Endpoint != "":
+		opts = append(opts, otlptracegrpc.WithEndpoint(t.Endpoint))
+	}
+	if t.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(t.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(t.Headers))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// newPropagator combines the configured propagation formats, W3C trace context by default.
+func newPropagator(names []string) propagation.TextMapPropagator {
+	if len(names) == 0 {
+		names = []string{config.PropagatorTraceContext}
+	}
+
+	propagators := make([]propagation.TextMapPropagator, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case config.PropagatorTraceContext:
+			propagators = append(propagators, propagation.TraceContext{})
+		case config.PropagatorBaggage:
+			propagators = append(propagators, propagation.Baggage{})
+		case config.PropagatorB3:
+			propagators = append(propagators, b3.New())
+		case config.PropagatorB3Multi:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...)
+}
+
+// Middleware traces the requests served by a vhost. The trace context of the request is
+// continued, and the server span is named after the route pattern of the endpoint that
+// served it. WebSocket sessions are traced for as long as they last.
+func Middleware(vhost string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.URLPath(r.URL.Path),
+					semconv.ServerAddress(r.Host),
+					semconv.ClientAddress(r.RemoteAddr),
+					VhostKey.String(vhost),
+					RequestIDKey.String(middleware.GetReqID(r.Context())),
+				),
+			)
+			defer span.End()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				if route := rctx.RoutePattern(); route != "" {
+					span.SetName(r.Method + " " + route)
+					span.SetAttributes(semconv.HTTPRoute(route), EndpointKey.String(route))
+				}
+			}
+
+			status := ww.Status()
+			switch {
+			case status == 0 && ww.BytesWritten() == 0 && r.Header.Get("Upgrade") != "":
+				status = http.StatusSwitchingProtocols // The connection was hijacked.
+			case status == 0:
+				status = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
+
+// StartUpstream starts the client span of a request sent to a backend target, and
+// injects its trace context in the headers of the request.
+func StartUpstream(ctx context.Context, backend, method, url string, header http.Header) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(method),
+			semconv.URLFull(url),
+			BackendKey.String(backend),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	return ctx, span
+}
+
+// EndUpstream ends the client span of a request with its outcome. The status is the one
+// of the response, or 0 when there is none.
+func EndUpstream(span trace.Span, status int, err error) {
+	defer span.End()
+
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case status >= http.StatusInternalServerError:
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
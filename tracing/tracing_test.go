@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/yarlson/GateH8/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const parentTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(newPropagator(nil))
+
+	upstreamHeader := http.Header{}
+	r := chi.NewRouter()
+	r.Use(Middleware("api.example.com"))
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartUpstream(r.Context(), "api.example.com/users/{id}", http.MethodGet, "http://backend/users/1", upstreamHeader)
+		EndUpstream(span, http.StatusBadGateway, nil)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.Header.Set("Traceparent", parentTraceparent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	client, server := spans[0], spans[1]
+
+	if server.Name() != "GET /users/{id}" || server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span = %s (%s), want GET /users/{id} (server)", server.Name(), server.SpanKind())
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want the incoming span", got)
+	}
+	if client.SpanKind() != trace.SpanKindClient || client.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("client span is not a child of the server span")
+	}
+
+	wantTraceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanContext().SpanID().String() + "-01"
+	if got := upstreamHeader.Get("Traceparent"); got != wantTraceparent {
+		t.Errorf("upstream traceparent = %q, want %q", got, wantTraceparent)
+	}
+
+	attributes := map[string]string{}
+	for _, kv := range server.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	for key, want := range map[string]string{
+		"gateh8.vhost":              "api.example.com",
+		"http.route":                "/users/{id}",
+		"http.response.status_code": "502",
+	} {
+		if attributes[key] != want {
+			t.Errorf("server span attribute %s = %q, want %q", key, attributes[key], want)
+		}
+	}
+}
+
+func TestNewPropagator(t *testing.T) {
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name        string
+		propagators []string
+		want        map[string]string // Header name to expected value prefix.
+	}{
+		{
+			name: "default",
+			want: map[string]string{"Traceparent": "00-" + traceID},
+		},
+		{
+			name:        "b3",
+			propagators: []string{config.PropagatorB3},
+			want:        map[string]string{"B3": traceID + "-" + spanID},
+		},
+		{
+			name:        "b3 multi",
+			propagators: []string{config.PropagatorB3Multi},
+			want:        map[string]string{"X-B3-Traceid": traceID, "X-B3-Spanid": spanID},
+		},
+		{
+			name:        "trace context and b3",
+			propagators: []string{config.PropagatorTraceContext, config.PropagatorB3},
+			want:        map[string]string{"Traceparent": "00-" + traceID, "B3": traceID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incoming := http.Header{"Traceparent": {parentTraceparent}}
+			ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(incoming))
+
+			header := http.Header{}
+			newPropagator(tt.propagators).Inject(ctx, propagation.HeaderCarrier(header))
+
+			for name, prefix := range tt.want {
+				if got := header.Get(name); !strings.HasPrefix(got, prefix) {
+					t.Errorf("%s = %q, want prefix %q", name, got, prefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package upstream
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Balancer picks one target out of a list of candidates for a given request.
+// Implementations must be safe for concurrent use.
+type Balancer interface {
+	Pick(candidates []*Target, r *http.Request) *Target
+}
+
+// NewBalancer creates the Balancer described by the configuration. Targets is the full
+// list of targets of the pool; strategies that precompute state (such as the hash ring)
+// build it from this list.
+func NewBalancer(c *config.BalancerConfig, targets []*Target) Balancer {
+	if c == nil {
+		return newRoundRobin()
+	}
+
+	switch c.Strategy {
+	case config.WeightedRandom:
+		return &weightedRandom{}
+	case config.LeastConnections:
+		return &leastConnections{}
+	case config.ConsistentHash:
+		return newConsistentHash(c, targets)
+	default:
+		return newRoundRobin()
+	}
+}
+
+// roundRobin implements the smooth weighted round-robin algorithm used by nginx:
+// targets are visited in proportion to their weights without bursts to the heaviest one.
+type roundRobin struct {
+	mu      sync.Mutex
+	current map[*Target]int
+}
+
+func newRoundRobin() *roundRobin {
+	return &roundRobin{current: make(map[*Target]int)}
+}
+
+func (b *roundRobin) Pick(candidates []*Target, _ *http.Request) *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Target
+	total := 0
+	for _, t := range candidates {
+		b.current[t] += t.Weight
+		total += t.Weight
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	if best != nil {
+		b.current[best] -= total
+	}
+	return best
+}
+
+// weightedRandom picks a random target with a probability proportional to its weight.
+type weightedRandom struct{}
+
+func (b *weightedRandom) Pick(candidates []*Target, _ *http.Request) *Target {
+	total := 0
+	for _, t := range candidates {
+		total += t.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, t := range candidates {
+		n -= t.Weight
+		if n < 0 {
+			return t
+		}
+	}
+	return nil
+}
+
+// leastConnections picks the target with the fewest in-flight requests relative to its weight.
+type leastConnections struct {
+	mu     sync.Mutex
+	offset int
+}
+
+func (b *leastConnections) Pick(candidates []*Target, _ *http.Request) *Target {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Rotate the starting point so that ties are spread across targets.
+	b.mu.Lock()
+	b.offset++
+	start := b.offset
+	b.mu.Unlock()
+
+	var best *Target
+	for i := range candidates {
+		t := candidates[(start+i)%len(candidates)]
+		// Compare active/weight ratios without dividing: a/wa < b/wb <=> a*wb < b*wa.
+		if best == nil || t.ActiveConnections()*int64(best.Weight) < best.ActiveConnections()*int64(t.Weight) {
+			best = t
+		}
+	}
+	return best
+}
+
+// replicasPerWeight is the number of points a target of weight 1 gets on the hash ring.
+const replicasPerWeight = 100
+
+type ringPoint struct {
+	hash   uint32
+	target *Target
+}
+
+// consistentHash maps a request key (header, cookie or client IP) onto a hash ring so that
+// the same key keeps reaching the same target while the set of targets stays unchanged.
+// Requests without a key fall back to round-robin.
+type consistentHash struct {
+	hashOn   string
+	hashKey  string
+	ring     []ringPoint
+	fallback *roundRobin
+}
+
+func newConsistentHash(c *config.BalancerConfig, targets []*Target) *consistentHash {
+	b := &consistentHash{
+		hashOn:   c.HashOn,
+		hashKey:  c.HashKey,
+		fallback: newRoundRobin(),
+	}
+
+	for _, t := range targets {
+		for i := 0; i < t.Weight*replicasPerWeight; i++ {
+			b.ring = append(b.ring, ringPoint{hash: hashKey(t.URL + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return b
+}
+
+func (b *consistentHash) Pick(candidates []*Target, r *http.Request) *Target {
+	key := b.requestKey(r)
+	if key == "" || len(b.ring) == 0 {
+		return b.fallback.Pick(candidates, r)
+	}
+
+	allowed := make(map[*Target]bool, len(candidates))
+	for _, t := range candidates {
+		allowed[t] = true
+	}
+
+	// Walk the ring clockwise from the key's position until an allowed target is found.
+	h := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+	for i := 0; i < len(b.ring); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		if allowed[point.target] {
+			return point.target
+		}
+	}
+	return nil
+}
+
+func (b *consistentHash) requestKey(r *http.Request) string {
+	switch b.hashOn {
+	case config.HashOnHeader:
+		return r.Header.Get(b.hashKey)
+	case config.HashOnCookie:
+		if cookie, err := r.Cookie(b.hashKey); err == nil {
+			return cookie.Value
+		}
+		return ""
+	default:
+		return clientIP(r)
+	}
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// clientIP returns the IP part of the request's remote address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"testing"
+)
+
+func newTestPool(balancer *config.BalancerConfig, targets ...config.Target) *Pool {
+	return NewPool("test", &config.Backend{Targets: targets, Balancer: balancer})
+}
+
+func TestRoundRobinWeights(t *testing.T) {
+	pool := newTestPool(nil,
+		config.Target{URL: "http://a", Weight: 3},
+		config.Target{URL: "http://b", Weight: 1},
+	)
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		target, err := pool.Next(r)
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		counts[target.URL]++
+	}
+
+	if counts["http://a"] != 6 || counts["http://b"] != 2 {
+		t.Errorf("round-robin distribution = %v, want a:6 b:2", counts)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool := newTestPool(&config.BalancerConfig{Strategy: config.LeastConnections},
+		config.Target{URL: "http://a"},
+		config.Target{URL: "http://b"},
+	)
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	busy := pool.Targets()[0]
+	busy.Acquire()
+	defer busy.Release()
+
+	for i := 0; i < 4; i++ {
+		target, _ := pool.Next(r)
+		if target.URL != "http://b" {
+			t.Errorf("Next() = %s, want http://b", target.URL)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		balancer *config.BalancerConfig
+		prepare  func(r *http.Request, key string)
+	}{
+		{
+			name:     "header",
+			balancer: &config.BalancerConfig{Strategy: config.ConsistentHash, HashOn: config.HashOnHeader, HashKey: "X-User"},
+			prepare:  func(r *http.Request, key string) { r.Header.Set("X-User", key) },
+		},
+		{
+			name:     "cookie",
+			balancer: &config.BalancerConfig{Strategy: config.ConsistentHash, HashOn: config.HashOnCookie, HashKey: "session"},
+			prepare:  func(r *http.Request, key string) { r.AddCookie(&http.Cookie{Name: "session", Value: key}) },
+		},
+		{
+			name:     "ip",
+			balancer: &config.BalancerConfig{Strategy: config.ConsistentHash, HashOn: config.HashOnIP},
+			prepare:  func(r *http.Request, key string) { r.RemoteAddr = key + ":1234" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.balancer,
+				config.Target{URL: "http://a"},
+				config.Target{URL: "http://b"},
+				config.Target{URL: "http://c"},
+			)
+
+			for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+				var first string
+				for i := 0; i < 5; i++ {
+					r, _ := http.NewRequest(http.MethodGet, "/", nil)
+					tt.prepare(r, key)
+					target, err := pool.Next(r)
+					if err != nil {
+						t.Fatalf("Next() error = %v", err)
+					}
+					if first == "" {
+						first = target.URL
+					} else if target.URL != first {
+						t.Errorf("key %s routed to %s and %s", key, first, target.URL)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package upstream
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults, used when the corresponding setting is left empty.
+const (
+	defaultBreakerMinRequests      = 20
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerCoolDown         = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request until the cool-down has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe requests through.
+	BreakerHalfOpen
+)
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a circuit breaker guarding a single target. It counts the outcome of the
+// requests sent to the target in fixed windows and trips once the configured thresholds
+// are reached.
+type Breaker struct {
+	errorRatio          float64
+	minRequests         int
+	consecutiveFailures int
+	window              time.Duration
+	coolDown            time.Duration
+	halfOpenRequests    int
+
+	mu               sync.Mutex
+	state            BreakerState
+	changedAt        time.Time
+	windowStart      time.Time
+	requests         int
+	failures         int
+	consecutive      int
+	halfOpenInFlight int
+	halfOpenPassed   int
+	onChange         func(from, to BreakerState)
+}
+
+// NewBreaker creates a closed circuit breaker from its configuration.
+func NewBreaker(c *config.CircuitBreaker) *Breaker {
+	b := &Breaker{
+		errorRatio:          c.ErrorRatio,
+		minRequests:         c.MinRequests,
+		consecutiveFailures: c.ConsecutiveFailures,
+		window:              c.Window.Or(defaultBreakerWindow),
+		coolDown:            c.CoolDown.Or(defaultBreakerCoolDown),
+		halfOpenRequests:    c.HalfOpenRequests,
+	}
+	if b.minRequests <= 0 {
+		b.minRequests = defaultBreakerMinRequests
+	}
+	if b.halfOpenRequests <= 0 {
+		b.halfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return b
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Ready reports whether the breaker would currently let a request through.
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ready(time.Now())
+}
+
+func (b *Breaker) ready(now time.Time) bool {
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.changedAt) >= b.coolDown
+	case BreakerHalfOpen:
+		// Probes that never reported back must not keep the circuit half-open forever.
+		return b.halfOpenInFlight < b.halfOpenRequests || now.Sub(b.changedAt) >= b.coolDown
+	default:
+		return true
+	}
+}
+
+// Allow reserves the right to send a request through the breaker. Every allowed
+// request must be followed by a call to Record with its outcome.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if !b.ready(now) {
+		return false
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		b.setState(BreakerHalfOpen, now)
+	case BreakerHalfOpen:
+		if now.Sub(b.changedAt) >= b.coolDown {
+			b.changedAt = now
+			b.halfOpenInFlight = 0
+		}
+	default:
+		return true
+	}
+	b.halfOpenInFlight++
+	return true
+}
+
+// Record reports the outcome of a request previously allowed by the breaker.
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.halfOpenInFlight > 0 {
+			b.halfOpenInFlight--
+		}
+		if !success {
+			b.setState(BreakerOpen, now)
+			return
+		}
+		b.halfOpenPassed++
+		if b.halfOpenPassed >= b.halfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		b.requests++
+		if success {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		if b.tripped() {
+			b.setState(BreakerOpen, now)
+		}
+	}
+}
+
+func (b *Breaker) tripped() bool {
+	if b.consecutiveFailures > 0 && b.consecutive >= b.consecutiveFailures {
+		return true
+	}
+	return b.errorRatio > 0 && b.requests >= b.minRequests &&
+		float64(b.failures)/float64(b.requests) >= b.errorRatio
+}
+
+// inherit takes over the state of the previous breaker of the same target, along with the
+// outcomes it counted. Probes still in flight report to the previous breaker, so they are
+// not carried over.
+func (b *Breaker) inherit(previous *Breaker) {
+	previous.mu.Lock()
+	state, changedAt, windowStart := previous.state, previous.changedAt, previous.windowStart
+	requests, failures, consecutive, halfOpenPassed := previous.requests, previous.failures, previous.consecutive, previous.halfOpenPassed
+	previous.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state, b.changedAt, b.windowStart = state, changedAt, windowStart
+	b.requests, b.failures, b.consecutive, b.halfOpenPassed = requests, failures, consecutive, halfOpenPassed
+	b.halfOpenInFlight = 0
+}
+
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	from := b.state
+	b.state = state
+	b.changedAt = now
+	b.windowStart = now
+	b.requests, b.failures, b.consecutive = 0, 0, 0
+	b.halfOpenInFlight, b.halfOpenPassed = 0, 0
+	if b.onChange != nil && from != state {
+		b.onChange(from, state)
+	}
+}
@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b := NewBreaker(&config.CircuitBreaker{ConsecutiveFailures: 3, CoolDown: config.Duration(time.Hour)})
+
+	for i := 0; i < 2; i++ {
+		b.Allow()
+		b.Record(false)
+	}
+	b.Allow()
+	b.Record(true)
+	if b.State() != BreakerClosed {
+		t.Fatalf("State() = %s, want closed after a success", b.State())
+	}
+
+	for i := 0; i < 3; i++ {
+		b.Allow()
+		b.Record(false)
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("State() = %s, want open", b.State())
+	}
+	if b.Allow() {
+		t.Errorf("Allow() = true during cool-down")
+	}
+}
+
+func TestBreakerErrorRatio(t *testing.T) {
+	b := NewBreaker(&config.CircuitBreaker{ErrorRatio: 0.5, MinRequests: 4, Window: config.Duration(time.Hour)})
+
+	outcomes := []bool{true, false, true, false}
+	for _, success := range outcomes {
+		b.Allow()
+		b.Record(success)
+	}
+	if b.State() != BreakerOpen {
+		t.Errorf("State() = %s, want open", b.State())
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		success bool
+		want    BreakerState
+	}{
+		{name: "recovered", success: true, want: BreakerClosed},
+		{name: "still failing", success: false, want: BreakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(&config.CircuitBreaker{ConsecutiveFailures: 1, CoolDown: config.Duration(time.Millisecond)})
+			b.Allow()
+			b.Record(false)
+			time.Sleep(2 * time.Millisecond)
+
+			if !b.Allow() {
+				t.Fatalf("Allow() = false after cool-down")
+			}
+			if b.State() != BreakerHalfOpen {
+				t.Fatalf("State() = %s, want half-open", b.State())
+			}
+			if b.Ready() {
+				t.Errorf("Ready() = true with the only probe in flight")
+			}
+
+			b.Record(tt.success)
+			if b.State() != tt.want {
+				t.Errorf("State() = %s, want %s", b.State(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolSkipsOpenCircuits(t *testing.T) {
+	pool := NewPool("test", &config.Backend{
+		Targets: []config.Target{{URL: "http://a"}, {URL: "http://b"}},
+		CircuitBreaker: &config.CircuitBreaker{
+			ConsecutiveFailures: 1,
+			CoolDown:            config.Duration(time.Hour),
+		},
+	})
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	for _, target := range pool.Targets() {
+		target.breaker.Allow()
+		target.Report(target.URL == "http://b")
+	}
+	for i := 0; i < 3; i++ {
+		target, err := pool.Next(r)
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if target.URL != "http://b" {
+			t.Errorf("Next() = %s, want http://b", target.URL)
+		}
+		target.Report(i < 2)
+	}
+
+	if _, err := pool.Next(r); err != ErrCircuitOpen {
+		t.Errorf("Next() error = %v, want %v", err, ErrCircuitOpen)
+	}
+}
@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Health check defaults, used when the corresponding setting is left empty.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// healthChecker periodically probes a single target and flips its health state once
+// the configured number of consecutive successes or failures has been reached.
+type healthChecker struct {
+	pool      string
+	target    *Target
+	mode      string
+	probeURL  string
+	address   string
+	expected  int
+	interval  time.Duration
+	timeout   time.Duration
+	rise      int
+	fall      int
+	client    *http.Client
+	successes int
+	failures  int
+}
+
+func newHealthChecker(pool string, target *Target, c *config.HealthCheck) (*healthChecker, error) {
+	u, err := targetBaseURL(target.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &healthChecker{
+		pool:     pool,
+		target:   target,
+		mode:     c.Mode,
+		expected: c.ExpectedStatus,
+		interval: c.Interval.Or(defaultHealthCheckInterval),
+		timeout:  c.Timeout.Or(defaultHealthCheckTimeout),
+		rise:     c.Rise,
+		fall:     c.Fall,
+	}
+	if hc.rise == 0 {
+		hc.rise = defaultHealthCheckRise
+	}
+	if hc.fall == 0 {
+		hc.fall = defaultHealthCheckFall
+	}
+
+	// WebSocket backends are probed with a plain TCP connection unless told otherwise.
+	if hc.mode == "" {
+		hc.mode = config.HealthCheckHTTP
+		if u.Scheme == "ws" || u.Scheme == "wss" {
+			hc.mode = config.HealthCheckTCP
+		}
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	hc.address = u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		hc.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	hc.probeURL = u.Scheme + "://" + u.Host + c.Path
+	hc.client = &http.Client{
+		Timeout: hc.timeout,
+		// Redirects are reported as they are, so that they can be matched by expectedStatus.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return hc, nil
+}
+
+// targetBaseURL parses a target URL template, ignoring any placeholders in it.
+func targetBaseURL(rawURL string) (*url.URL, error) {
+	if i := strings.Index(rawURL, "${"); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target url %s: %w", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("target url %s has no host", rawURL)
+	}
+	return u, nil
+}
+
+// run probes the target until the context is cancelled.
+func (hc *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		hc.observe(hc.probe(ctx))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) probe(ctx context.Context) error {
+	if hc.mode == config.HealthCheckTCP {
+		dialer := net.Dialer{Timeout: hc.timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", hc.address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.probeURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "GateH8 health check")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if hc.expected != 0 && resp.StatusCode != hc.expected {
+		return fmt.Errorf("unexpected status %d, want %d", resp.StatusCode, hc.expected)
+	}
+	if hc.expected == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// observe records the outcome of a probe and updates the health state of the target.
+func (hc *healthChecker) observe(err error) {
+	entry := logger.L.WithFields(logrus.Fields{
+		"pool":   hc.pool,
+		"target": hc.target.URL,
+	})
+
+	if err != nil {
+		hc.successes = 0
+		hc.failures++
+		if hc.failures == hc.fall && hc.target.Healthy() {
+			hc.target.unhealthy.Store(true)
+			entry.WithError(err).Warn("Upstream target is unhealthy")
+		}
+		return
+	}
+
+	hc.failures = 0
+	hc.successes++
+	if hc.successes == hc.rise && !hc.target.Healthy() {
+		hc.target.unhealthy.Store(false)
+		entry.Info("Upstream target is healthy again")
+	}
+}
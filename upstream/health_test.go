@@ -0,0 +1,70 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheckerRiseFall(t *testing.T) {
+	target := &Target{Target: config.Target{URL: "http://127.0.0.1:1", Weight: 1}}
+	hc, err := newHealthChecker("test", target, &config.HealthCheck{Rise: 2, Fall: 2})
+	if err != nil {
+		t.Fatalf("newHealthChecker() error = %v", err)
+	}
+
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{errors.New("down"), true},
+		{errors.New("down"), false},
+		{nil, false},
+		{errors.New("down"), false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		hc.observe(step.err)
+		if target.Healthy() != step.healthy {
+			t.Errorf("step %d: Healthy() = %v, want %v", i, target.Healthy(), step.healthy)
+		}
+	}
+}
+
+func TestHealthCheckerProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		check   config.HealthCheck
+		wantErr bool
+	}{
+		{name: "http", url: srv.URL + "${path}", check: config.HealthCheck{Path: "/healthz"}},
+		{name: "http wrong path", url: srv.URL, check: config.HealthCheck{Path: "/missing"}, wantErr: true},
+		{name: "expected status", url: srv.URL, check: config.HealthCheck{Path: "/missing", ExpectedStatus: 404}},
+		{name: "websocket tcp", url: "ws" + srv.URL[len("http"):] + "/ws"},
+		{name: "tcp refused", url: "http://127.0.0.1:1", check: config.HealthCheck{Mode: config.HealthCheckTCP}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &Target{Target: config.Target{URL: tt.url, Weight: 1}}
+			hc, err := newHealthChecker("test", target, &tt.check)
+			if err != nil {
+				t.Fatalf("newHealthChecker() error = %v", err)
+			}
+			if err := hc.probe(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
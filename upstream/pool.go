@@ -0,0 +1,198 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrNoTargets is returned by Pool.Next when no target is available to serve a request.
+var ErrNoTargets = errors.New("no upstream target available")
+
+// ErrCircuitOpen is returned by Pool.Next when the only healthy targets have open circuits.
+var ErrCircuitOpen = fmt.Errorf("%w: circuit open", ErrNoTargets)
+
+// Target is a single upstream server of a Pool. It keeps track of the number of
+// in-flight requests and sessions so that connection-aware strategies can use it.
+type Target struct {
+	config.Target
+	active    atomic.Int64
+	unhealthy atomic.Bool
+	draining  atomic.Bool
+	breaker   *Breaker
+}
+
+// Healthy reports whether the target passes its health checks.
+// Targets of backends without health checks are always healthy.
+func (t *Target) Healthy() bool {
+	return !t.unhealthy.Load()
+}
+
+// Available reports whether the target can be picked to serve new requests.
+func (t *Target) Available() bool {
+	return t.Healthy() && !t.Draining() && (t.breaker == nil || t.breaker.Ready())
+}
+
+// Draining reports whether the target is being drained: it keeps serving the requests and
+// sessions it already has, but is not picked for new ones.
+func (t *Target) Draining() bool {
+	return t.draining.Load()
+}
+
+// SetDraining starts or stops draining the target.
+func (t *Target) SetDraining(draining bool) {
+	t.draining.Store(draining)
+}
+
+// Breaker returns the circuit breaker of the target, or nil if the backend has none configured.
+func (t *Target) Breaker() *Breaker {
+	return t.breaker
+}
+
+// Report records the outcome of a request served by the target. Every target returned
+// by Pool.Next must be reported once, so that its circuit breaker can track it.
+func (t *Target) Report(success bool) {
+	if t.breaker != nil {
+		t.breaker.Record(success)
+	}
+}
+
+// Acquire marks the start of a request or session served by the target.
+func (t *Target) Acquire() {
+	t.active.Add(1)
+}
+
+// Release marks the end of a request or session previously started with Acquire.
+func (t *Target) Release() {
+	t.active.Add(-1)
+}
+
+// ActiveConnections returns the number of in-flight requests and sessions of the target.
+func (t *Target) ActiveConnections() int64 {
+	return t.active.Load()
+}
+
+// Pool is a set of upstream targets of a single backend, together with the
+// balancing strategy used to pick one of them for each incoming request.
+type Pool struct {
+	name        string
+	targets     []*Target
+	balancer    Balancer
+	healthCheck *config.HealthCheck
+}
+
+// NewPool builds a Pool from a backend configuration. Targets without an explicit
+// weight get a weight of 1, and round-robin is used when no strategy is configured.
+// The name identifies the pool in logs and introspection output.
+func NewPool(name string, backend *config.Backend) *Pool {
+	targets := make([]*Target, 0, len(backend.GetTargets()))
+	for _, t := range backend.GetTargets() {
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		target := &Target{Target: t}
+		if backend.CircuitBreaker != nil {
+			target.breaker = NewBreaker(backend.CircuitBreaker)
+			target.breaker.onChange = func(from, to BreakerState) {
+				logger.L.WithFields(logrus.Fields{
+					"pool":   name,
+					"target": target.URL,
+					"from":   from.String(),
+					"to":     to.String(),
+				}).Warn("Upstream target circuit changed state")
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	return &Pool{
+		name:        name,
+		targets:     targets,
+		balancer:    NewBalancer(backend.Balancer, targets),
+		healthCheck: backend.HealthCheck,
+	}
+}
+
+// Name returns the name of the pool.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Targets returns all the targets of the pool.
+func (p *Pool) Targets() []*Target {
+	return p.targets
+}
+
+// Next picks the target that should serve the given request.
+func (p *Pool) Next(r *http.Request) (*Target, error) {
+	healthy := false
+	candidates := make([]*Target, 0, len(p.targets))
+	for _, t := range p.targets {
+		healthy = healthy || (t.Healthy() && !t.Draining())
+		if t.Available() {
+			candidates = append(candidates, t)
+		}
+	}
+
+	for len(candidates) > 0 {
+		target := p.balancer.Pick(candidates, r)
+		if target == nil {
+			break
+		}
+		if target.breaker == nil || target.breaker.Allow() {
+			return target, nil
+		}
+
+		// The circuit filled up with half-open probes in the meantime; try another target.
+		for i, t := range candidates {
+			if t == target {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if healthy && p.targets[0].breaker != nil {
+		return nil, ErrCircuitOpen
+	}
+	return nil, ErrNoTargets
+}
+
+// TargetStatus is a snapshot of the state of a target, as exposed by the admin listener.
+type TargetStatus struct {
+	URL               string `json:"url"`
+	Weight            int    `json:"weight"`
+	Healthy           bool   `json:"healthy"`
+	Draining          bool   `json:"draining,omitempty"`
+	Circuit           string `json:"circuit,omitempty"`
+	ActiveConnections int64  `json:"activeConnections"`
+}
+
+// PoolStatus is a snapshot of the state of a pool and its targets.
+type PoolStatus struct {
+	Name    string         `json:"name"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+// Status returns a snapshot of the state of the pool.
+func (p *Pool) Status() PoolStatus {
+	status := PoolStatus{Name: p.name, Targets: make([]TargetStatus, 0, len(p.targets))}
+	for _, t := range p.targets {
+		ts := TargetStatus{
+			URL:               t.URL,
+			Weight:            t.Weight,
+			Healthy:           t.Healthy(),
+			Draining:          t.Draining(),
+			ActiveConnections: t.ActiveConnections(),
+		}
+		if t.breaker != nil {
+			ts.Circuit = t.breaker.State().String()
+		}
+		status.Targets = append(status.Targets, ts)
+	}
+	return status
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/yarlson/GateH8/config"
+	"github.com/yarlson/GateH8/logger"
+	"sort"
+	"sync"
+)
+
+// ErrPoolNotFound is returned when no pool is registered under the requested name.
+var ErrPoolNotFound = errors.New("backend not found")
+
+// ErrTargetNotFound is returned when a pool has no target with the requested URL.
+var ErrTargetNotFound = errors.New("target not found")
+
+// Registry keeps track of all the pools built for a configuration and owns the
+// background health checks of their targets.
+type Registry struct {
+	mu     sync.RWMutex
+	pools  map[string]*Pool
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{pools: make(map[string]*Pool)}
+}
+
+// NewPool builds a pool for the backend and registers it under the given name.
+func (reg *Registry) NewPool(name string, backend *config.Backend) *Pool {
+	pool := NewPool(name, backend)
+
+	reg.mu.Lock()
+	reg.pools[name] = pool
+	reg.mu.Unlock()
+
+	return pool
+}
+
+// Pool returns the pool registered under the given name.
+func (reg *Registry) Pool(name string) (*Pool, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	pool, ok := reg.pools[name]
+	return pool, ok
+}
+
+// Pools returns all the registered pools, sorted by name.
+func (reg *Registry) Pools() []*Pool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	pools := make([]*Pool, 0, len(reg.pools))
+	for _, pool := range reg.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	return pools
+}
+
+// Status returns a snapshot of the state of all the registered pools.
+func (reg *Registry) Status() []PoolStatus {
+	pools := reg.Pools()
+	status := make([]PoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		status = append(status, pool.Status())
+	}
+	return status
+}
+
+// Drain starts or stops draining the target with the given URL of the named pool.
+func (reg *Registry) Drain(pool, url string, draining bool) error {
+	p, ok := reg.Pool(pool)
+	if !ok {
+		return ErrPoolNotFound
+	}
+	for _, target := range p.targets {
+		if target.URL == url {
+			target.SetDraining(draining)
+			return nil
+		}
+	}
+	return ErrTargetNotFound
+}
+
+// Inherit carries the state of the targets of the previous registry over to the targets
+// with the same URL in the pools with the same name, so that it survives configuration
+// reloads: draining, health, as long as the pool still has health checks to restore it,
+// and the state of the circuit breaker, as long as the target still has one.
+func (reg *Registry) Inherit(previous *Registry) {
+	for _, prevPool := range previous.Pools() {
+		pool, ok := reg.Pool(prevPool.name)
+		if !ok {
+			continue
+		}
+		for _, prev := range prevPool.targets {
+			for _, target := range pool.targets {
+				if target.URL != prev.URL {
+					continue
+				}
+				target.SetDraining(prev.Draining())
+				if pool.healthCheck != nil {
+					target.unhealthy.Store(!prev.Healthy())
+				}
+				if target.breaker != nil && prev.breaker != nil {
+					target.breaker.inherit(prev.breaker)
+				}
+			}
+		}
+	}
+}
+
+// Start launches the health checks of every registered pool that has them configured.
+func (reg *Registry) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	reg.cancel = cancel
+
+	for _, pool := range reg.Pools() {
+		if pool.healthCheck == nil {
+			continue
+		}
+		for _, target := range pool.targets {
+			hc, err := newHealthChecker(pool.name, target, pool.healthCheck)
+			if err != nil {
+				logger.L.Errorf("Health checks disabled for %s of %s: %v", target.URL, pool.name, err)
+				continue
+			}
+
+			reg.wg.Add(1)
+			go func() {
+				defer reg.wg.Done()
+				hc.run(ctx)
+			}()
+		}
+	}
+}
+
+// Close stops the health checks and waits for them to return.
+func (reg *Registry) Close() {
+	if reg.cancel != nil {
+		reg.cancel()
+	}
+	reg.wg.Wait()
+}
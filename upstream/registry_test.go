@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"github.com/yarlson/GateH8/config"
+	"net/http"
+	"testing"
+)
+
+func TestRegistryDrain(t *testing.T) {
+	backend := &config.Backend{Targets: []config.Target{{URL: "http://a"}, {URL: "http://b"}}}
+	reg := NewRegistry()
+	pool := reg.NewPool("test", backend)
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+
+	tests := []struct {
+		name    string
+		pool    string
+		url     string
+		wantErr error
+	}{
+		{name: "target", pool: "test", url: "http://a"},
+		{name: "unknown pool", pool: "nope", url: "http://a", wantErr: ErrPoolNotFound},
+		{name: "unknown target", pool: "test", url: "http://c", wantErr: ErrTargetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := reg.Drain(tt.pool, tt.url, true); err != tt.wantErr {
+				t.Errorf("Drain() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		target, err := pool.Next(r)
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if target.URL != "http://b" {
+			t.Errorf("Next() = %s, want http://b", target.URL)
+		}
+	}
+
+	// Draining survives reloads.
+	reloaded := NewRegistry()
+	reloadedPool := reloaded.NewPool("test", backend)
+	reloaded.Inherit(reg)
+	if status := reloadedPool.Status(); !status.Targets[0].Draining || status.Targets[1].Draining {
+		t.Errorf("Status() = %+v, want only http://a draining", status)
+	}
+
+	if err := reg.Drain("test", "http://b", true); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if _, err := pool.Next(r); err != ErrNoTargets {
+		t.Errorf("Next() error = %v, want %v", err, ErrNoTargets)
+	}
+}
+
+func TestRegistryInherit(t *testing.T) {
+	backend := &config.Backend{
+		Targets:        []config.Target{{URL: "http://a"}, {URL: "http://b"}},
+		HealthCheck:    &config.HealthCheck{Path: "/health"},
+		CircuitBreaker: &config.CircuitBreaker{ConsecutiveFailures: 1},
+	}
+	reg := NewRegistry()
+	pool := reg.NewPool("test", backend)
+	pool.targets[0].unhealthy.Store(true)
+	pool.targets[1].Report(false)
+
+	tests := []struct {
+		name        string
+		backend     *config.Backend
+		pool        string
+		wantHealthy []bool
+		wantBreaker []BreakerState
+	}{
+		{
+			name:        "same backend",
+			backend:     backend,
+			pool:        "test",
+			wantHealthy: []bool{false, true},
+			wantBreaker: []BreakerState{BreakerClosed, BreakerOpen},
+		},
+		{
+			name:        "changed targets",
+			backend:     &config.Backend{Targets: []config.Target{{URL: "http://b"}, {URL: "http://c"}}, HealthCheck: backend.HealthCheck, CircuitBreaker: backend.CircuitBreaker},
+			pool:        "test",
+			wantHealthy: []bool{true, true},
+			wantBreaker: []BreakerState{BreakerOpen, BreakerClosed},
+		},
+		{
+			// Without health checks, nothing would ever mark the target healthy again.
+			name:        "health checks removed",
+			backend:     &config.Backend{Targets: backend.Targets, CircuitBreaker: backend.CircuitBreaker},
+			pool:        "test",
+			wantHealthy: []bool{true, true},
+			wantBreaker: []BreakerState{BreakerClosed, BreakerOpen},
+		},
+		{
+			name:        "other pool",
+			backend:     backend,
+			pool:        "other",
+			wantHealthy: []bool{true, true},
+			wantBreaker: []BreakerState{BreakerClosed, BreakerClosed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaded := NewRegistry()
+			reloadedPool := reloaded.NewPool(tt.pool, tt.backend)
+			reloaded.Inherit(reg)
+			for i, target := range reloadedPool.targets {
+				if got := target.Healthy(); got != tt.wantHealthy[i] {
+					t.Errorf("%s Healthy() = %v, want %v", target.URL, got, tt.wantHealthy[i])
+				}
+				if got := target.Breaker().State(); got != tt.wantBreaker[i] {
+					t.Errorf("%s breaker state = %v, want %v", target.URL, got, tt.wantBreaker[i])
+				}
+			}
+		})
+	}
+}